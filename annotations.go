@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// Annotations are -- @name arguments comments before a statement.
+const (
+	annotationOutput      = "output"
+	annotationExpect      = "expect"
+	annotationExpectError = "expect-error"
+)
+
+// outputsEnvKey is the step output listing all exported outputs as a JSON object.
+const outputsEnvKey = "SQL_OUTPUTS"
+
+var (
+	annotationPattern = regexp.MustCompile(`^--\s*@([a-z][a-z-]*)(?:\s+(.*))?$`)
+	envKeyPattern     = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// annotation is a -- @name arguments comment in the leading comments of a statement. Unknown names are ignored,
+// they may be regular comments.
+type annotation struct {
+	name string
+	args string
+}
+
+// parseAnnotations returns the known annotations of the leading comments of a statement.
+func parseAnnotations(text string) []annotation {
+	var annotations []annotation
+	for _, line := range strings.Split(text[:skipComments(text)], "\n") {
+		match := annotationPattern.FindStringSubmatch(strings.TrimSpace(line))
+		if match == nil {
+			continue
+		}
+		switch match[1] {
+		case annotationOutput, annotationExpect, annotationExpectError:
+			annotations = append(annotations, annotation{name: match[1], args: strings.TrimSpace(match[2])})
+		}
+	}
+	return annotations
+}
+
+// outputAnnotation is an @output annotation: export the first value of the result, or the whole result as JSON.
+//
+//	-- @output SCHEMA_VERSION
+//	-- @output FEATURE_FLAGS json
+type outputAnnotation struct {
+	key  string
+	json bool
+}
+
+func parseOutputAnnotation(args string) (outputAnnotation, error) {
+	fields := strings.Fields(args)
+	if len(fields) == 0 || len(fields) > 2 {
+		return outputAnnotation{}, fmt.Errorf("invalid @output annotation: %q, expected: @output NAME [json]", args)
+	}
+	if !envKeyPattern.MatchString(fields[0]) {
+		return outputAnnotation{}, fmt.Errorf("invalid @output name: %s", fields[0])
+	}
+	output := outputAnnotation{key: fields[0]}
+	if len(fields) == 2 {
+		if fields[1] != "json" {
+			return outputAnnotation{}, fmt.Errorf("invalid @output annotation: %q, expected: @output NAME [json]", args)
+		}
+		output.json = true
+	}
+	return output, nil
+}
+
+// validateAnnotations checks the annotations of a statement before anything runs. The result of
+// a \gset query is stored in variables, it can not be annotated.
+func validateAnnotations(stmt statement, gset bool) error {
+	if gset && len(stmt.annotations) > 0 {
+		return fmt.Errorf("@%s can not be used on a \\gset query", stmt.annotations[0].name)
+	}
+	var expectErrors int
+	for _, a := range stmt.annotations {
+		switch a.name {
+		case annotationOutput:
+			if _, err := parseOutputAnnotation(a.args); err != nil {
+				return err
+			}
+			if !returnsRows(stmt.node) {
+				return fmt.Errorf("@output requires a statement returning rows, got: %s", statementType(stmt.node))
+			}
+		case annotationExpect:
+			expectations, err := parseExpectations(a.args)
+			if err != nil {
+				return err
+			}
+			for _, e := range expectations {
+				if e.field == "value" && !returnsRows(stmt.node) {
+					return fmt.Errorf("@expect value requires a statement returning rows, got: %s", statementType(stmt.node))
+				}
+			}
+		case annotationExpectError:
+			if _, err := parseExpectedError(a.args); err != nil {
+				return err
+			}
+			expectErrors++
+		}
+	}
+	if expectErrors > 0 && len(stmt.annotations) > expectErrors {
+		return fmt.Errorf("@expect-error can not be combined with other annotations")
+	}
+	if expectErrors > 1 {
+		return fmt.Errorf("only one @expect-error annotation is allowed per statement")
+	}
+	return nil
+}
+
+// resultCapture records the first result set of a statement for its annotations.
+type resultCapture struct {
+	json    *jsonWriter // writes the whole result set to buffer, if it is needed
+	buffer  bytes.Buffer
+	first   []cell
+	rows    int
+	columns []column
+}
+
+func newResultCapture(annotations []annotation) *resultCapture {
+	c := &resultCapture{}
+	for _, a := range annotations {
+		if a.name == annotationOutput {
+			if output, err := parseOutputAnnotation(a.args); err == nil && output.json {
+				c.json = &jsonWriter{w: &c.buffer}
+			}
+		}
+	}
+	return c
+}
+
+func (c *resultCapture) header(columns []column) error {
+	c.columns = columns
+	if c.json != nil {
+		return c.json.header(columns)
+	}
+	return nil
+}
+
+func (c *resultCapture) row(cells []cell) error {
+	c.rows++
+	if c.first == nil {
+		c.first = make([]cell, len(cells))
+		copy(c.first, cells)
+	}
+	if c.json != nil {
+		return c.json.row(cells)
+	}
+	return nil
+}
+
+func (c *resultCapture) close() error {
+	if c.json != nil {
+		return c.json.close()
+	}
+	return nil
+}
+
+// outputs exports the @output annotations of a statement from its captured result.
+type outputs struct {
+	exported map[string]string
+}
+
+func (o *outputs) export(annotations []annotation, capture *resultCapture) error {
+	for _, a := range annotations {
+		if a.name != annotationOutput {
+			continue
+		}
+		output, err := parseOutputAnnotation(a.args)
+		if err != nil {
+			return err
+		}
+
+		var value string
+		switch {
+		case output.json:
+			value = strings.TrimSuffix(capture.buffer.String(), "\n")
+		case capture.first == nil:
+			return fmt.Errorf("@output %s: the query returned no rows", output.key)
+		case len(capture.first) == 0:
+			return fmt.Errorf("@output %s: the query returned no columns", output.key)
+		case !capture.first[0].null:
+			value = capture.first[0].text
+		}
+
+		if err := exportEnv(output.key, value); err != nil {
+			return fmt.Errorf("@output %s: %s", output.key, err)
+		}
+		if o.exported == nil {
+			o.exported = map[string]string{}
+		}
+		o.exported[output.key] = value
+		log.Donef("Exported output: %s", output.key)
+	}
+	return nil
+}
+
+// exportSummary exports all outputs as a JSON object, if any was exported.
+func (o *outputs) exportSummary() error {
+	if len(o.exported) == 0 {
+		return nil
+	}
+	summary, err := json.Marshal(o.exported)
+	if err != nil {
+		return err
+	}
+	return exportEnv(outputsEnvKey, string(summary))
+}
+
+// exportEnv exports an environment variable for the next steps with envman.
+func exportEnv(key, value string) error {
+	cmd := exec.Command("envman", "add", "--key", key, "--value", value)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to export %s with envman, error: %s, output: %s", key, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseAnnotations(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want []annotation
+	}{
+		{
+			name: "leading comments",
+			text: "-- @output VERSION\n--@expect rows=1\n-- @unknown x\n-- plain comment\nSELECT 1",
+			want: []annotation{{annotationOutput, "VERSION"}, {annotationExpect, "rows=1"}},
+		},
+		{
+			name: "expect error",
+			text: "-- @expect-error 23505\nINSERT INTO t VALUES (1)",
+			want: []annotation{{annotationExpectError, "23505"}},
+		},
+		{
+			name: "comments after the statement start are ignored",
+			text: "SELECT 1\n-- @output VERSION\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseAnnotations(tt.text); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseAnnotations() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateAnnotations(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{name: "output", content: "-- @output VERSION json\nSELECT 1;"},
+		{name: "expect rows of an update", content: "-- @expect rows>=1\nUPDATE t SET a = 1;"},
+		{name: "expect value", content: "-- @expect rows=1 value='ok'\nSELECT 'ok';"},
+		{name: "expect error", content: "-- @expect-error 23505\nINSERT INTO t VALUES (1);"},
+		{
+			name:    "output of an update",
+			content: "-- @output X\nUPDATE t SET a = 1;",
+			wantErr: "@output requires a statement returning rows",
+		},
+		{
+			name:    "expect value of an update",
+			content: "-- @expect value=1\nUPDATE t SET a = 1;",
+			wantErr: "@expect value requires a statement returning rows",
+		},
+		{
+			name:    "invalid expect",
+			content: "-- @expect size=1\nSELECT 1;",
+			wantErr: "invalid @expect condition",
+		},
+		{
+			name:    "invalid expect error code",
+			content: "-- @expect-error unique\nSELECT 1;",
+			wantErr: "invalid @expect-error code",
+		},
+		{
+			name:    "expect error with output",
+			content: "-- @expect-error 23505\n-- @output X\nSELECT 1;",
+			wantErr: "@expect-error can not be combined with other annotations",
+		},
+		{
+			name:    "gset query",
+			content: "-- @expect rows=1\nSELECT 1 AS a \\gset\nSELECT :a;",
+			wantErr: "@expect can not be used on a \\gset query",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pre, err := preprocessScript("test.sql", "test.sql", tt.content, nil)
+			if err != nil {
+				t.Fatalf("preprocessScript() error: %s", err)
+			}
+			statements, commands, err := pre.split()
+			if err != nil {
+				t.Fatalf("split() error: %s", err)
+			}
+			gset := len(commands) > 0 && commands[0].name == commandGset
+
+			err = validateAnnotations(statements[0], gset)
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("validateAnnotations() error: %s", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("validateAnnotations() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/bitrise-io/go-utils/log"
+	"github.com/lib/pq"
+)
+
+type dbInfo struct {
+	url            string // postgres:// URL or libpq key/value connection string
+	host           string
+	port           int
+	username       string
+	password       string
+	databaseName   string
+	sslmode        string
+	sslrootcert    string
+	sslcert        string
+	sslkey         string
+	connectTimeout int
+
+	applicationName string
+	session         []sessionSetting
+}
+
+// connectionParams returns the connection parameters parsed from the URL, overridden by the discrete fields that are set.
+func (i dbInfo) connectionParams() (map[string]string, error) {
+	params, err := parseConnectionString(i.url)
+	if err != nil {
+		return nil, err
+	}
+
+	set := func(key, value string) {
+		if value != "" {
+			params[key] = value
+		}
+	}
+	set("host", i.host)
+	if i.port != 0 {
+		set("port", strconv.Itoa(i.port))
+	}
+	set("user", i.username)
+	set("password", i.password)
+	set("dbname", i.databaseName)
+	set("sslmode", i.sslmode)
+	set("sslrootcert", i.sslrootcert)
+	set("sslcert", i.sslcert)
+	set("sslkey", i.sslkey)
+	if i.connectTimeout != 0 {
+		set("connect_timeout", strconv.Itoa(i.connectTimeout))
+	}
+	set("application_name", i.applicationName)
+	return params, nil
+}
+
+// parseConnectionString parses a postgres:// URL (with pq.ParseURL) or a libpq key/value connection string.
+func parseConnectionString(s string) (map[string]string, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "postgres://") || strings.HasPrefix(s, "postgresql://") {
+		converted, err := pq.ParseURL(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid database URL, error: %s", err)
+		}
+		s = converted
+	}
+	return parseKeyValues(s)
+}
+
+// parseKeyValues parses a libpq key/value connection string (host=localhost password='it\'s secret').
+// Values are either single quoted or end at whitespace, backslash escapes the next character.
+func parseKeyValues(s string) (map[string]string, error) {
+	params := map[string]string{}
+	r := []rune(s)
+	i := 0
+	skipSpaces := func() {
+		for i < len(r) && unicode.IsSpace(r[i]) {
+			i++
+		}
+	}
+
+	for {
+		skipSpaces()
+		if i >= len(r) {
+			return params, nil
+		}
+
+		start := i
+		for i < len(r) && r[i] != '=' && !unicode.IsSpace(r[i]) {
+			i++
+		}
+		key := string(r[start:i])
+		skipSpaces()
+		if i >= len(r) || r[i] != '=' {
+			return nil, fmt.Errorf("invalid connection string, missing \"=\" after %q", key)
+		}
+		i++
+		skipSpaces()
+
+		var value []rune
+		if i < len(r) && r[i] == '\'' {
+			i++
+			for {
+				if i >= len(r) {
+					return nil, fmt.Errorf("invalid connection string, unterminated quoted value of %q", key)
+				}
+				if r[i] == '\'' {
+					i++
+					break
+				}
+				if r[i] == '\\' && i+1 < len(r) {
+					i++
+				}
+				value = append(value, r[i])
+				i++
+			}
+		} else {
+			for i < len(r) && !unicode.IsSpace(r[i]) {
+				if r[i] == '\\' && i+1 < len(r) {
+					i++
+				}
+				value = append(value, r[i])
+				i++
+			}
+		}
+		params[key] = string(value)
+	}
+}
+
+// formatConnectionString formats connection parameters as a libpq key/value string. All values are
+// quoted, so values with spaces, quotes or backslashes (for example passwords) are passed as is.
+func formatConnectionString(params map[string]string) string {
+	keys := make([]string, 0, len(params))
+	for key := range params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	escaper := strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+	parts := make([]string, len(keys))
+	for i, key := range keys {
+		parts[i] = fmt.Sprintf("%s='%s'", key, escaper.Replace(params[key]))
+	}
+	return strings.Join(parts, " ")
+}
+
+func connectToDB(dbInfo dbInfo, retry retryPolicy) (*sql.DB, error) {
+	params, err := dbInfo.connectionParams()
+	if err != nil {
+		return nil, err
+	}
+	connector, err := pq.NewConnector(formatConnectionString(params))
+	if err != nil {
+		return nil, err
+	}
+	db := sql.OpenDB(sessionConnector{
+		Connector: connector,
+		settings:  dbInfo.session,
+	})
+
+	for attempt := 0; ; attempt++ {
+		err = db.Ping()
+		if err == nil {
+			break
+		}
+		if attempt >= retry.retries || !isRetryableConnectError(err) {
+			if cerr := db.Close(); cerr != nil {
+				log.Warnf("failed to close DB")
+			}
+			return nil, fmt.Errorf("failed to connect to database %s after %d attempt(s), error: %s", params["dbname"], attempt+1, err)
+		}
+
+		delay := retry.delay(attempt + 1)
+		log.Warnf("Database is not ready (%s), retrying in %s (%d/%d)", err, delay, attempt+1, retry.retries)
+		time.Sleep(delay)
+	}
+	log.Printf("Successfully connected!")
+	return db, nil
+}
+
+// serverVersion returns the server_version_num setting of the server, for example 110005.
+func serverVersion(db *sql.DB) (int, error) {
+	var version int
+	if err := db.QueryRow("SHOW server_version_num").Scan(&version); err != nil {
+		return 0, fmt.Errorf("failed to query server version, error: %s", err)
+	}
+	return version, nil
+}
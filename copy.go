@@ -0,0 +1,564 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/log"
+	"github.com/lib/pq"
+)
+
+// copyCommand is a client side \copy of a local file into a table. The file is read and sent
+// to the server with COPY FROM STDIN, so it does not have to be accessible by the server.
+type copyCommand struct {
+	schema    string
+	table     string
+	columns   []string
+	file      string
+	csv       bool
+	header    bool
+	delimiter byte
+	null      string
+	quote     byte
+	escape    byte
+}
+
+// statement returns the COPY statement lib/pq streams the rows with. Rows are sent in text format,
+// whatever the format of the file is.
+func (c copyCommand) statement() string {
+	table := pq.QuoteIdentifier(c.table)
+	if c.schema != "" {
+		table = pq.QuoteIdentifier(c.schema) + "." + table
+	}
+	if len(c.columns) == 0 {
+		return "COPY " + table + " FROM STDIN"
+	}
+	// pq.CopyIn and pq.CopyInSchema require the column list.
+	if c.schema != "" {
+		return pq.CopyInSchema(c.schema, c.table, c.columns...)
+	}
+	return pq.CopyIn(c.table, c.columns...)
+}
+
+// parseCopyCommand parses the arguments of \copy:
+//
+//	table [ ( column [, ...] ) ] FROM { 'file' | file } [ [ WITH ] ( option [, ...] ) ]
+//	table [ ( column [, ...] ) ] FROM { 'file' | file } [ CSV ] [ HEADER ] [ DELIMITER [ AS ] 'c' ] [ NULL [ AS ] 'null' ] ...
+//
+// Only copying from a file is supported, as the script has no stdin and results are not written to files.
+func parseCopyCommand(args string) (copyCommand, error) {
+	p := copyParser{s: args}
+	c := copyCommand{}
+
+	if p.peek() == "(" {
+		return c, fmt.Errorf(`\copy of a query is not supported, only copying from a file into a table`)
+	}
+	name, err := p.identifier()
+	if err != nil {
+		return c, err
+	}
+	c.table = name
+	if p.peek() == "." {
+		p.next()
+		if c.table, err = p.identifier(); err != nil {
+			return c, err
+		}
+		c.schema = name
+	}
+
+	if p.peek() == "(" {
+		p.next()
+		for {
+			column, err := p.identifier()
+			if err != nil {
+				return c, err
+			}
+			c.columns = append(c.columns, column)
+			if token := p.next(); token == ")" {
+				break
+			} else if token != "," {
+				return c, fmt.Errorf(`\copy: expected , or ) in the column list, got: %q`, token)
+			}
+		}
+	}
+
+	switch direction := strings.ToLower(p.next()); direction {
+	case "from":
+	case "to":
+		return c, fmt.Errorf(`\copy TO is not supported, only copying from a file into a table`)
+	default:
+		return c, fmt.Errorf(`\copy: expected FROM, got: %q`, direction)
+	}
+
+	if c.file = p.fileName(); c.file == "" {
+		return c, fmt.Errorf(`\copy requires a file name`)
+	}
+	switch strings.ToLower(c.file) {
+	case "stdin", "pstdin", "program":
+		return c, fmt.Errorf(`\copy FROM %s is not supported, only copying from a file`, c.file)
+	}
+
+	if strings.ToLower(p.peek()) == "with" {
+		p.next()
+	}
+	if p.peek() == "(" {
+		p.next()
+		for {
+			option := strings.ToLower(p.next())
+			value := ""
+			if next := p.peek(); next != "," && next != ")" {
+				value = p.next()
+			}
+			if err := c.setOption(option, value); err != nil {
+				return c, err
+			}
+			if token := p.next(); token == ")" {
+				break
+			} else if token != "," {
+				return c, fmt.Errorf(`\copy: expected , or ) in the option list, got: %q`, token)
+			}
+		}
+	} else {
+		for token := p.next(); token != ""; token = p.next() {
+			option := strings.ToLower(token)
+			value := ""
+			switch option {
+			case "csv":
+				option, value = "format", "csv"
+			case "delimiter", "null", "quote", "escape":
+				if strings.ToLower(p.peek()) == "as" {
+					p.next()
+				}
+				value = p.next()
+			}
+			if err := c.setOption(option, value); err != nil {
+				return c, err
+			}
+		}
+	}
+	if token := p.next(); token != "" {
+		return c, fmt.Errorf(`\copy: unexpected %q`, token)
+	}
+
+	if c.delimiter == 0 {
+		c.delimiter = '\t'
+		if c.csv {
+			c.delimiter = ','
+		}
+	}
+	if c.quote == 0 {
+		c.quote = '"'
+	}
+	if c.escape == 0 {
+		c.escape = c.quote
+	}
+	return c, nil
+}
+
+func (c *copyCommand) setOption(option, value string) error {
+	switch option {
+	case "format":
+		switch strings.ToLower(value) {
+		case "csv":
+			c.csv = true
+		case "text":
+			c.csv = false
+		default:
+			return fmt.Errorf(`\copy: unsupported format: %s`, value)
+		}
+	case "header":
+		header := true
+		if value != "" {
+			var ok bool
+			if header, ok = parsePsqlBool(unquoteCopyString(value)); !ok {
+				return fmt.Errorf(`\copy: invalid header value: %s`, value)
+			}
+		}
+		c.header = header
+	case "delimiter", "quote", "escape":
+		s := unquoteCopyString(value)
+		if len(s) != 1 {
+			return fmt.Errorf(`\copy: %s must be a single one-byte character`, option)
+		}
+		switch option {
+		case "delimiter":
+			c.delimiter = s[0]
+		case "quote":
+			c.quote = s[0]
+		case "escape":
+			c.escape = s[0]
+		}
+	case "null":
+		if value == "" {
+			return fmt.Errorf(`\copy: null requires a value`)
+		}
+		null := unquoteCopyString(value)
+		c.null = null
+		if null == "" {
+			// Distinguish an explicit empty string from the default, which depends on the format.
+			c.null = "\x00"
+		}
+	case "binary":
+		return fmt.Errorf(`\copy: binary format is not supported`)
+	default:
+		return fmt.Errorf(`\copy: unsupported option: %s`, option)
+	}
+	return nil
+}
+
+// nullString returns the string that represents NULL in the file.
+func (c copyCommand) nullString() string {
+	switch c.null {
+	case "":
+		if c.csv {
+			return ""
+		}
+		return `\N`
+	case "\x00":
+		return ""
+	default:
+		return c.null
+	}
+}
+
+// copyParser splits the arguments of \copy into tokens: punctuation, quoted strings, quoted identifiers and words.
+type copyParser struct {
+	s string
+	i int
+}
+
+func (p *copyParser) skipSpace() {
+	for p.i < len(p.s) && (p.s[p.i] == ' ' || p.s[p.i] == '\t' || p.s[p.i] == '\r' || p.s[p.i] == '\n') {
+		p.i++
+	}
+}
+
+func (p *copyParser) next() string {
+	p.skipSpace()
+	if p.i >= len(p.s) {
+		return ""
+	}
+	start := p.i
+	switch c := p.s[p.i]; c {
+	case '(', ')', ',', '.':
+		p.i++
+	case '\'', '"':
+		p.i += quotedLength(p.s[p.i:], c, false)
+	default:
+		for p.i < len(p.s) && !strings.ContainsRune(" \t\r\n(),.'\"", rune(p.s[p.i])) {
+			p.i++
+		}
+	}
+	return p.s[start:p.i]
+}
+
+func (p *copyParser) peek() string {
+	i := p.i
+	token := p.next()
+	p.i = i
+	return token
+}
+
+// identifier reads a table or column name, folding unquoted names to lower case like the server does.
+func (p *copyParser) identifier() (string, error) {
+	token := p.next()
+	switch {
+	case token == "" || strings.ContainsAny(token[:1], "(),.'"):
+		return "", fmt.Errorf(`\copy: expected a name, got: %q`, token)
+	case token[0] == '"':
+		if len(token) < 2 || token[len(token)-1] != '"' {
+			return "", fmt.Errorf(`\copy: unterminated quoted name: %s`, token)
+		}
+		return strings.Replace(token[1:len(token)-1], `""`, `"`, -1), nil
+	default:
+		return strings.ToLower(token), nil
+	}
+}
+
+// fileName reads a quoted file name, or an unquoted one up to the next whitespace.
+func (p *copyParser) fileName() string {
+	p.skipSpace()
+	if p.i < len(p.s) && p.s[p.i] == '\'' {
+		return unquoteCopyString(p.next())
+	}
+	start := p.i
+	for p.i < len(p.s) && !strings.ContainsRune(" \t\r\n", rune(p.s[p.i])) {
+		p.i++
+	}
+	return p.s[start:p.i]
+}
+
+func unquoteCopyString(s string) string {
+	if len(s) >= 2 && s[0] == '\'' && s[len(s)-1] == '\'' {
+		return strings.Replace(s[1:len(s)-1], "''", "'", -1)
+	}
+	return s
+}
+
+// copyFrom streams the rows of a local file into a table and returns the number of rows copied.
+func copyFrom(db queryer, c copyCommand) (int64, error) {
+	file, err := os.Open(c.file)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open file: %s, error: %s", c.file, err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			log.Warnf("failed to close file: %s, error: %s", c.file, err)
+		}
+	}()
+
+	// lib/pq only supports COPY inside a transaction.
+	q := db
+	var tx *sql.Tx
+	if beginner, ok := db.(interface{ Begin() (*sql.Tx, error) }); ok {
+		if tx, err = beginner.Begin(); err != nil {
+			return 0, fmt.Errorf("failed to begin transaction, error: %s", err)
+		}
+		q = tx
+	}
+
+	rows, err := copyRows(q, c, newCopyReader(c, file))
+	if tx != nil {
+		if err != nil {
+			rollback(tx)
+			return 0, err
+		}
+		if err := tx.Commit(); err != nil {
+			return 0, fmt.Errorf("failed to commit transaction, error: %s", err)
+		}
+	}
+	return rows, err
+}
+
+func copyRows(q queryer, c copyCommand, reader *copyReader) (int64, error) {
+	stmt, err := q.Prepare(c.statement())
+	if err != nil {
+		return 0, fmt.Errorf("failed to start copy, error: %w", err)
+	}
+	defer func() {
+		if err := stmt.Close(); err != nil {
+			log.Warnf("failed to close copy, error: %s", err)
+		}
+	}()
+
+	for {
+		values, err := reader.read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, fmt.Errorf("%s:%d: %s", c.file, reader.line, err)
+		}
+		if _, err := stmt.Exec(values...); err != nil {
+			return 0, fmt.Errorf("%s:%d: failed to copy row, error: %w", c.file, reader.line, err)
+		}
+	}
+
+	result, err := stmt.Exec()
+	if err != nil {
+		return 0, fmt.Errorf("failed to copy %s, error: %w", c.file, err)
+	}
+	return result.RowsAffected()
+}
+
+// copyReader reads the rows of a file in the CSV or text format of COPY.
+type copyReader struct {
+	c      copyCommand
+	r      *bufio.Reader
+	line   int
+	header bool
+}
+
+func newCopyReader(c copyCommand, r io.Reader) *copyReader {
+	return &copyReader{
+		c:      c,
+		r:      bufio.NewReader(r),
+		header: c.header,
+	}
+}
+
+// read returns the values of the next row, nil for NULL, or io.EOF after the last row.
+func (r *copyReader) read() ([]interface{}, error) {
+	for {
+		var values []interface{}
+		var err error
+		if r.c.csv {
+			values, err = r.readCSV()
+		} else {
+			values, err = r.readText()
+		}
+		if err != nil || !r.header {
+			return values, err
+		}
+		r.header = false
+	}
+}
+
+func (r *copyReader) readLine() (string, error) {
+	line, err := r.r.ReadString('\n')
+	if err == io.EOF && line == "" {
+		return "", io.EOF
+	}
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	r.line++
+	return line, nil
+}
+
+func trimLineEnd(line string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+}
+
+// readText reads a row of the text format: delimited fields with backslash escapes.
+func (r *copyReader) readText() ([]interface{}, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return nil, err
+	}
+	line = trimLineEnd(line)
+	if line == `\.` {
+		return nil, io.EOF
+	}
+
+	var values []interface{}
+	start := 0
+	for i := 0; i <= len(line); i++ {
+		if i+1 < len(line) && line[i] == '\\' {
+			i++
+			continue
+		}
+		if i < len(line) && line[i] != r.c.delimiter {
+			continue
+		}
+		field := line[start:i]
+		if field == r.c.nullString() {
+			values = append(values, nil)
+		} else {
+			values = append(values, unescapeCopyText(field))
+		}
+		start = i + 1
+	}
+	return values, nil
+}
+
+// unescapeCopyText resolves the backslash escapes of the text format.
+func unescapeCopyText(field string) string {
+	if !strings.Contains(field, `\`) {
+		return field
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(field); i++ {
+		if field[i] != '\\' || i+1 == len(field) {
+			b.WriteByte(field[i])
+			continue
+		}
+		i++
+		switch c := field[i]; {
+		case c == 'b':
+			b.WriteByte('\b')
+		case c == 'f':
+			b.WriteByte('\f')
+		case c == 'n':
+			b.WriteByte('\n')
+		case c == 'r':
+			b.WriteByte('\r')
+		case c == 't':
+			b.WriteByte('\t')
+		case c == 'v':
+			b.WriteByte('\v')
+		case c >= '0' && c <= '7':
+			end := i + 1
+			for end < len(field) && end < i+3 && field[end] >= '0' && field[end] <= '7' {
+				end++
+			}
+			v, _ := strconv.ParseUint(field[i:end], 8, 8)
+			b.WriteByte(byte(v))
+			i = end - 1
+		case c == 'x' && i+1 < len(field) && isHexDigit(field[i+1]):
+			end := i + 2
+			if end < len(field) && isHexDigit(field[end]) {
+				end++
+			}
+			v, _ := strconv.ParseUint(field[i+1:end], 16, 8)
+			b.WriteByte(byte(v))
+			i = end - 1
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func isHexDigit(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
+
+// readCSV reads a CSV record, which may span lines inside quoted fields. An unquoted field matching
+// the null string is NULL, a quoted one is a string.
+func (r *copyReader) readCSV() ([]interface{}, error) {
+	var values []interface{}
+	var field strings.Builder
+	quoted, inQuotes := false, false
+	first := true
+
+	for {
+		line, err := r.readLine()
+		if err == io.EOF && !first {
+			return nil, fmt.Errorf("unterminated CSV quoted field")
+		}
+		if err != nil {
+			return nil, err
+		}
+		body := trimLineEnd(line)
+		if first && body == `\.` {
+			return nil, io.EOF
+		}
+		first = false
+
+		for i := 0; i < len(body); i++ {
+			c := body[i]
+			switch {
+			case inQuotes && c == r.c.escape && r.c.escape != r.c.quote && i+1 < len(body) && (body[i+1] == r.c.quote || body[i+1] == r.c.escape):
+				field.WriteByte(body[i+1])
+				i++
+			case inQuotes && c == r.c.quote:
+				if r.c.escape == r.c.quote && i+1 < len(body) && body[i+1] == r.c.quote {
+					field.WriteByte(c)
+					i++
+				} else {
+					inQuotes = false
+				}
+			case inQuotes:
+				field.WriteByte(c)
+			case c == r.c.quote:
+				inQuotes, quoted = true, true
+			case c == r.c.delimiter:
+				values = append(values, r.csvValue(field.String(), quoted))
+				field.Reset()
+				quoted = false
+			default:
+				field.WriteByte(c)
+			}
+		}
+
+		if inQuotes {
+			field.WriteString(line[len(body):])
+			continue
+		}
+		return append(values, r.csvValue(field.String(), quoted)), nil
+	}
+}
+
+func (r *copyReader) csvValue(field string, quoted bool) interface{} {
+	if !quoted && field == r.c.nullString() {
+		return nil
+	}
+	return field
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseCopyCommand(t *testing.T) {
+	tests := []struct {
+		args    string
+		want    copyCommand
+		null    string
+		wantErr string
+	}{
+		{
+			args: `users FROM 'users.csv' CSV HEADER`,
+			want: copyCommand{table: "users", file: "users.csv", csv: true, header: true, delimiter: ',', quote: '"', escape: '"'},
+			null: "",
+		},
+		{
+			args: `app.users (id, "Name") FROM users.csv WITH (FORMAT csv, HEADER true, DELIMITER ';', NULL 'x', QUOTE '''', ESCAPE '\')`,
+			want: copyCommand{schema: "app", table: "users", columns: []string{"id", "Name"}, file: "users.csv", csv: true, header: true, delimiter: ';', null: "x", quote: '\'', escape: '\\'},
+			null: "x",
+		},
+		{
+			args: `"My Table" FROM 'f.txt'`,
+			want: copyCommand{table: "My Table", file: "f.txt", delimiter: '\t', quote: '"', escape: '"'},
+			null: `\N`,
+		},
+		{
+			args: `t FROM 'f.txt' DELIMITER AS '|' NULL AS ''`,
+			want: copyCommand{table: "t", file: "f.txt", delimiter: '|', null: "\x00", quote: '"', escape: '"'},
+			null: "",
+		},
+		{args: `(SELECT 1) TO 'x'`, wantErr: `\copy of a query is not supported, only copying from a file into a table`},
+		{args: `t TO 'x'`, wantErr: `\copy TO is not supported, only copying from a file into a table`},
+		{args: `t FROM stdin`, wantErr: `\copy FROM stdin is not supported, only copying from a file`},
+		{args: `t FROM`, wantErr: `\copy requires a file name`},
+		{args: `t (a b) FROM 'x'`, wantErr: `\copy: expected , or ) in the column list, got: "b"`},
+		{args: `t FROM 'x' (FORMAT binary)`, wantErr: `\copy: unsupported format: binary`},
+		{args: `t FROM 'x' (DELIMITER ';;')`, wantErr: `\copy: delimiter must be a single one-byte character`},
+		{args: `t FROM 'x' (FOO 1)`, wantErr: `\copy: unsupported option: foo`},
+		{args: `t FROM 'x' extra`, wantErr: `\copy: unsupported option: extra`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.args, func(t *testing.T) {
+			got, err := parseCopyCommand(tt.args)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("parseCopyCommand() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseCopyCommand() error: %s", err)
+			}
+			if len(got.columns) == 0 {
+				got.columns = nil
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseCopyCommand() = %+v, want %+v", got, tt.want)
+			}
+			if null := got.nullString(); null != tt.null {
+				t.Errorf("nullString() = %q, want %q", null, tt.null)
+			}
+		})
+	}
+}
+
+func readCopyRows(c copyCommand, input string) ([][]interface{}, error) {
+	reader := newCopyReader(c, strings.NewReader(input))
+	var rows [][]interface{}
+	for {
+		values, err := reader.read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil {
+			return rows, err
+		}
+		rows = append(rows, values)
+	}
+}
+
+func TestCopyReaderText(t *testing.T) {
+	text := copyCommand{delimiter: '\t', quote: '"', escape: '"'}
+	tests := []struct {
+		name  string
+		c     copyCommand
+		input string
+		want  [][]interface{}
+	}{
+		{
+			name:  "fields and NULL",
+			c:     text,
+			input: "1\ta\n2\t\\N\n",
+			want:  [][]interface{}{{"1", "a"}, {"2", nil}},
+		},
+		{
+			name:  "escapes",
+			c:     text,
+			input: "a\\tb\\nc\\\\d\t\\101\\x42\\q\n",
+			want:  [][]interface{}{{"a\tb\nc\\d", "ABq"}},
+		},
+		{
+			name:  "escaped delimiter",
+			c:     copyCommand{delimiter: '|'},
+			input: "a\\|b|c\r\n",
+			want:  [][]interface{}{{"a|b", "c"}},
+		},
+		{
+			name:  "empty fields and a trailing backslash",
+			c:     text,
+			input: "\t\t\\\n",
+			want:  [][]interface{}{{"", "", "\\"}},
+		},
+		{
+			name:  "header and end of data marker",
+			c:     copyCommand{delimiter: '\t', header: true},
+			input: "id\tname\n1\ta\n\\.\n2\tb\n",
+			want:  [][]interface{}{{"1", "a"}},
+		},
+		{
+			name:  "custom NULL",
+			c:     copyCommand{delimiter: ',', null: "-"},
+			input: "-,\\N\n",
+			want:  [][]interface{}{{nil, "N"}},
+		},
+		{
+			name:  "no line break at the end",
+			c:     text,
+			input: "1\ta",
+			want:  [][]interface{}{{"1", "a"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readCopyRows(tt.c, tt.input)
+			if err != nil {
+				t.Fatalf("read() error: %s", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("read() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCopyReaderCSV(t *testing.T) {
+	csv := copyCommand{csv: true, delimiter: ',', quote: '"', escape: '"'}
+	tests := []struct {
+		name    string
+		c       copyCommand
+		input   string
+		want    [][]interface{}
+		wantErr string
+	}{
+		{
+			name:  "quoted and unquoted NULL",
+			c:     csv,
+			input: "1,,\"\"\n",
+			want:  [][]interface{}{{"1", nil, ""}},
+		},
+		{
+			name:  "doubled quotes and delimiters in quotes",
+			c:     csv,
+			input: "\"a \"\"b\"\", c\",d\n",
+			want:  [][]interface{}{{"a \"b\", c", "d"}},
+		},
+		{
+			name:  "multi-line quoted field",
+			c:     csv,
+			input: "1,\"line 1\r\nline 2\"\n2,x\n",
+			want:  [][]interface{}{{"1", "line 1\r\nline 2"}, {"2", "x"}},
+		},
+		{
+			name:  "escape character",
+			c:     copyCommand{csv: true, delimiter: ',', quote: '"', escape: '\\'},
+			input: "\"a\\\"b\\\\c\\d\"\n",
+			want:  [][]interface{}{{"a\"b\\c\\d"}},
+		},
+		{
+			name:  "header, custom NULL and quoted NULL string",
+			c:     copyCommand{csv: true, header: true, delimiter: ';', null: "NULL", quote: '"', escape: '"'},
+			input: "id;name\n1;NULL\n2;\"NULL\"\n",
+			want:  [][]interface{}{{"1", nil}, {"2", "NULL"}},
+		},
+		{
+			name:    "unterminated quoted field",
+			c:       csv,
+			input:   "1,\"open\n",
+			wantErr: "unterminated CSV quoted field",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readCopyRows(tt.c, tt.input)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("read() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("read() error: %s", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("read() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCopyStatement(t *testing.T) {
+	tests := []struct {
+		c    copyCommand
+		want string
+	}{
+		{copyCommand{table: "users"}, `COPY "users" FROM STDIN`},
+		{copyCommand{schema: "app", table: "My Users"}, `COPY "app"."My Users" FROM STDIN`},
+		{copyCommand{table: "users", columns: []string{"id", "Name"}}, `COPY "users" ("id", "Name") FROM STDIN`},
+		{copyCommand{schema: "app", table: "users", columns: []string{"id"}}, `COPY "app"."users" ("id") FROM STDIN`},
+	}
+	for _, tt := range tests {
+		if got := tt.c.statement(); got != tt.want {
+			t.Errorf("statement() = %s, want %s", got, tt.want)
+		}
+	}
+}
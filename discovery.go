@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// scriptPatterns parses newline separated glob patterns. Patterns starting with ! exclude files.
+func scriptPatterns(value string) (include, exclude []string, err error) {
+	for _, line := range strings.Split(value, "\n") {
+		pattern := strings.TrimSpace(line)
+		if pattern == "" {
+			continue
+		}
+
+		negated := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+		if err := validatePattern(pattern); err != nil {
+			return nil, nil, err
+		}
+		if negated {
+			exclude = append(exclude, pattern)
+		} else {
+			include = append(include, pattern)
+		}
+	}
+	if len(include) == 0 {
+		return nil, nil, fmt.Errorf("no include pattern given")
+	}
+	return include, exclude, nil
+}
+
+func validatePattern(pattern string) error {
+	for _, segment := range strings.Split(pattern, "/") {
+		if _, err := path.Match(segment, ""); err != nil {
+			return fmt.Errorf("invalid pattern: %s, error: %s", pattern, err)
+		}
+	}
+	return nil
+}
+
+// matchGlob reports whether a slash separated relative path matches the pattern, ignoring case.
+// Each pattern segment is matched with path.Match, while ** matches any number of directories.
+func matchGlob(pattern, name string) bool {
+	return matchSegments(strings.Split(strings.ToLower(pattern), "/"), strings.Split(strings.ToLower(name), "/"))
+}
+
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, err := path.Match(pattern[0], name[0]); err != nil || !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matchGlob(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// discoverScripts walks dir recursively and returns the slash separated relative paths of the files
+// matching any include pattern and none of the exclude patterns, in path order (see comparePaths).
+func discoverScripts(dir string, include, exclude []string) ([]string, error) {
+	var names []string
+	err := filepath.Walk(dir, func(pth string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, pth)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if matchAny(include, name) && !matchAny(exclude, name) {
+			names = append(names, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to walk scripts dir: %s, error: %s", dir, err)
+	}
+
+	sort.Slice(names, func(i, j int) bool {
+		return comparePaths(names[i], names[j]) < 0
+	})
+	return names, nil
+}
+
+// comparePaths compares slash separated paths one directory level at a time, so all scripts of
+// a directory are ordered together: schema/b.sql < schema/sub/a.sql < schema-v2/a.sql.
+func comparePaths(a, b string) int {
+	as, bs := strings.Split(a, "/"), strings.Split(b, "/")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if as[i] != bs[i] {
+			return strings.Compare(as[i], bs[i])
+		}
+	}
+	return len(as) - len(bs)
+}
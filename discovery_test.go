@@ -0,0 +1,108 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{"*.sql", "a.sql", true},
+		{"*.sql", "V1__Init.SQL", true},
+		{"*.sql", "schema/a.sql", false},
+		{"*.sql", "a.sql.bak", false},
+		{"**/*.sql", "a.sql", true},
+		{"**/*.sql", "schema/sub/a.sql", true},
+		{"schema/*.sql", "schema/a.sql", true},
+		{"schema/*.sql", "schema/sub/a.sql", false},
+		{"schema/**", "schema/sub/a.sql", true},
+		{"**/drafts/**", "drafts/a.sql", true},
+		{"**/drafts/**", "schema/drafts/sub/a.sql", true},
+		{"**/drafts/**", "schema/drafts.sql", false},
+		{"V[0-9]*.sql", "v1__init.sql", true},
+		{"?.sql", "ab.sql", false},
+	}
+	for _, tt := range tests {
+		if got := matchGlob(tt.pattern, tt.name); got != tt.want {
+			t.Errorf("matchGlob(%q, %q) = %t, want %t", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestScriptPatterns(t *testing.T) {
+	include, exclude, err := scriptPatterns("**/*.sql\n\n  !**/drafts/**  \n*.psql\n")
+	if err != nil {
+		t.Fatalf("scriptPatterns() error: %s", err)
+	}
+	if want := []string{"**/*.sql", "*.psql"}; !reflect.DeepEqual(include, want) {
+		t.Errorf("scriptPatterns() include = %v, want %v", include, want)
+	}
+	if want := []string{"**/drafts/**"}; !reflect.DeepEqual(exclude, want) {
+		t.Errorf("scriptPatterns() exclude = %v, want %v", exclude, want)
+	}
+
+	for _, value := range []string{"", "!*.sql", "[a.sql"} {
+		if _, _, err := scriptPatterns(value); err == nil {
+			t.Errorf("scriptPatterns(%q) expected error", value)
+		}
+	}
+}
+
+func TestDiscoverScripts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "discovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	for _, name := range []string{"b.sql", "A.SQL", "notes.txt", "schema/b.sql", "schema/sub/a.sql", "schema-v2/a.sql", "drafts/x.sql"} {
+		pth := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(pth), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(pth, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		include []string
+		exclude []string
+		want    []string
+	}{
+		{
+			name:    "top level",
+			include: []string{"*.sql"},
+			want:    []string{"A.SQL", "b.sql"},
+		},
+		{
+			name:    "recursive with exclude",
+			include: []string{"**/*.sql"},
+			exclude: []string{"drafts/**"},
+			want:    []string{"A.SQL", "b.sql", "schema/b.sql", "schema/sub/a.sql", "schema-v2/a.sql"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := discoverScripts(dir, tt.include, tt.exclude)
+			if err != nil {
+				t.Fatalf("discoverScripts() error: %s", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("discoverScripts() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
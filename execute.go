@@ -0,0 +1,133 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// executor runs scripts against their target databases, wraps them in transactions
+// and records them in the migration history.
+type executor struct {
+	cfg           config
+	targets       map[string]*target
+	noTransaction map[string]bool
+	renderer      renderer
+	outputs       outputs
+	batch         *sql.Tx
+}
+
+// begin starts the transaction of transaction mode all.
+func (e *executor) begin(database string) error {
+	tx, err := e.targets[database].db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction, error: %s", err)
+	}
+	e.batch = tx
+	return nil
+}
+
+// commit commits the transaction of transaction mode all, if it was not rolled back.
+func (e *executor) commit() error {
+	if e.batch == nil {
+		return nil
+	}
+	if err := e.batch.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction, error: %s", err)
+	}
+	e.batch = nil
+	return nil
+}
+
+// run runs a script and reports whether it succeeded. Down scripts remove the script they
+// roll back from the migration history, other scripts are recorded in it.
+func (e *executor) run(script script) bool {
+	t := e.targets[script.database]
+
+	var q queryer
+	var tx *sql.Tx
+	pin := false
+	switch {
+	case e.noTransaction[script.name]:
+		log.Warnf("Running script without a transaction: %s", script.name)
+		pin = true
+	case script.transactionMode(e.cfg.TransactionMode) == transactionScript:
+		var err error
+		if tx, err = t.db.Begin(); err != nil {
+			panic(fmt.Errorf("failed to begin transaction, error: %s", err))
+		}
+		q = tx
+	case e.cfg.TransactionMode == transactionAll:
+		q = e.batch
+	default:
+		pin = true
+	}
+	if pin {
+		conn, err := pinConn(t.db)
+		if err != nil {
+			panic(err)
+		}
+		defer closeConn(conn)
+		q = conn
+	}
+
+	entry := appliedScript{
+		name:    script.name,
+		version: script.version,
+	}
+	if e.cfg.MigrationTracking && script.rollbackOf == "" {
+		var err error
+		if entry.checksum, err = checksum(e.cfg.ChecksumAlgorithm, script); err != nil {
+			panic(err)
+		}
+	}
+
+	startTime := time.Now()
+	runErr := runScript(q, script, &resultOutput{
+		format:   e.cfg.OutputFormat,
+		dir:      e.cfg.OutputDir,
+		script:   script.name,
+		maxRows:  e.cfg.MaxRowsDisplayed,
+		renderer: e.renderer,
+		outputs:  &e.outputs,
+	})
+	entry.duration = time.Since(startTime)
+
+	if runErr == nil && e.cfg.MigrationTracking {
+		if script.rollbackOf != "" {
+			runErr = t.history.in(q).remove(script.rollbackOf)
+		} else {
+			entry.success = true
+			runErr = t.history.in(q).record(entry)
+		}
+	}
+	if tx != nil {
+		if runErr == nil {
+			if err := tx.Commit(); err != nil {
+				runErr = fmt.Errorf("failed to commit transaction, error: %s", err)
+			}
+		} else {
+			rollback(tx)
+			log.Warnf("Rolled back script: %s", script.name)
+		}
+	}
+	if runErr == nil {
+		return true
+	}
+
+	log.Errorf("%s", runErr)
+	if e.batch != nil {
+		rollback(e.batch)
+		e.batch = nil
+		log.Warnf("Rolled back all scripts of the batch")
+	}
+	if e.cfg.MigrationTracking && script.rollbackOf == "" {
+		entry.success = false
+		if err := t.history.record(entry); err != nil {
+			panic(err)
+		}
+	}
+	return false
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// expectErrorSavepoint isolates a statement expected to fail, so the error does not abort the transaction.
+const expectErrorSavepoint = "run_sql_expect_error"
+
+var sqlStatePattern = regexp.MustCompile(`^[0-9A-Z]{5}$`)
+
+// expectation is a condition of an @expect annotation, checked against the result of its statement:
+//
+//	-- @expect rows=0
+//	-- @expect rows>=1 value='ok'
+//
+// rows is the number of rows returned, or affected by statements not returning rows.
+// value is the first column of the first row, as rendered in the results.
+type expectation struct {
+	field string
+	op    string
+	rows  int64
+	value *string // nil is NULL
+}
+
+var expectationOperators = map[string][]string{
+	"rows":  {"<=", ">=", "!=", "<>", "=", "<", ">"},
+	"value": {"!=", "<>", "="},
+}
+
+// parseExpectations parses the conditions of an @expect annotation, separated by whitespace.
+func parseExpectations(args string) ([]expectation, error) {
+	var expectations []expectation
+	rest := strings.TrimSpace(args)
+	if rest == "" {
+		return nil, fmt.Errorf("@expect requires a condition, for example: @expect rows=0")
+	}
+
+	for rest != "" {
+		end := strings.IndexAny(rest, "<>=!")
+		if end <= 0 {
+			return nil, fmt.Errorf("invalid @expect condition: %s", rest)
+		}
+		e := expectation{field: rest[:end]}
+		operators, ok := expectationOperators[e.field]
+		if !ok {
+			return nil, fmt.Errorf("invalid @expect condition: %s, expected rows or value", rest)
+		}
+		rest = rest[end:]
+		for _, op := range operators {
+			if strings.HasPrefix(rest, op) {
+				e.op = op
+				rest = rest[len(op):]
+				break
+			}
+		}
+		if e.op == "" {
+			return nil, fmt.Errorf("invalid @expect operator for %s: %s", e.field, rest)
+		}
+		if e.op == "<>" {
+			e.op = "!="
+		}
+
+		var value string
+		var err error
+		if value, rest, err = expectationValue(rest); err != nil {
+			return nil, err
+		}
+		switch {
+		case e.field == "rows":
+			if e.rows, err = strconv.ParseInt(value, 10, 64); err != nil || e.rows < 0 {
+				return nil, fmt.Errorf("invalid @expect rows: %s", value)
+			}
+		case strings.HasPrefix(value, "'"):
+			unquoted := strings.Replace(value[1:len(value)-1], "''", "'", -1)
+			e.value = &unquoted
+		case strings.EqualFold(value, "null"):
+		default:
+			e.value = &value
+		}
+		expectations = append(expectations, e)
+		rest = strings.TrimSpace(rest)
+	}
+	return expectations, nil
+}
+
+// expectationValue reads a quoted or unquoted value at the start of s and returns it with the rest of s.
+func expectationValue(s string) (string, string, error) {
+	if strings.HasPrefix(s, "'") {
+		n := quotedLength(s, '\'', false)
+		if n < 2 || s[n-1] != '\'' {
+			return "", "", fmt.Errorf("unterminated @expect value: %s", s)
+		}
+		return s[:n], s[n:], nil
+	}
+	end := strings.IndexAny(s, " \t")
+	if end == -1 {
+		end = len(s)
+	}
+	if end == 0 {
+		return "", "", fmt.Errorf("missing @expect value")
+	}
+	return s[:end], s[end:], nil
+}
+
+func (e expectation) String() string {
+	if e.field == "rows" {
+		return fmt.Sprintf("rows %s %d", e.op, e.rows)
+	}
+	return fmt.Sprintf("value %s %s", e.op, displayValue(e.value))
+}
+
+func displayValue(value *string) string {
+	if value == nil {
+		return "NULL"
+	}
+	return quoteLiteral(*value)
+}
+
+// check compares the expectation to the result of its statement, it returns a diff if it does not hold.
+func (e expectation) check(rows int64, capture *resultCapture) error {
+	if e.field == "rows" {
+		var ok bool
+		switch e.op {
+		case "=":
+			ok = rows == e.rows
+		case "!=":
+			ok = rows != e.rows
+		case "<":
+			ok = rows < e.rows
+		case "<=":
+			ok = rows <= e.rows
+		case ">":
+			ok = rows > e.rows
+		case ">=":
+			ok = rows >= e.rows
+		}
+		if !ok {
+			return expectationDiff(e.String(), fmt.Sprintf("rows = %d", rows))
+		}
+		return nil
+	}
+
+	if capture == nil || capture.first == nil || len(capture.first) == 0 {
+		return expectationDiff(e.String(), "no rows")
+	}
+	var actual *string
+	if first := capture.first[0]; !first.null {
+		actual = &first.text
+	}
+	equal := (actual == nil) == (e.value == nil) && (actual == nil || *actual == *e.value)
+	if equal != (e.op == "=") {
+		return expectationDiff(e.String(), "value = "+displayValue(actual))
+	}
+	return nil
+}
+
+func expectationDiff(expected, actual string) error {
+	return fmt.Errorf("expectation failed\n- expected: %s\n+ actual:   %s", expected, actual)
+}
+
+// parseExpectedError parses the SQLSTATE code of an @expect-error annotation.
+func parseExpectedError(args string) (string, error) {
+	code := strings.TrimSpace(args)
+	if !sqlStatePattern.MatchString(code) {
+		return "", fmt.Errorf("invalid @expect-error code: %q, expected a SQLSTATE code, for example: @expect-error 23505", code)
+	}
+	return code, nil
+}
+
+// expectedError returns the SQLSTATE code the statement is expected to fail with, if any.
+func expectedError(annotations []annotation) string {
+	for _, a := range annotations {
+		if a.name == annotationExpectError {
+			if code, err := parseExpectedError(a.args); err == nil {
+				return code
+			}
+		}
+	}
+	return ""
+}
+
+// checkExpectedError compares the error of a statement to the expected SQLSTATE code.
+func checkExpectedError(code string, err error) error {
+	var pqErr *pq.Error
+	switch {
+	case err == nil:
+		return fmt.Errorf("@expect-error %s: %s", code, expectationDiff("error "+code, "statement succeeded"))
+	case !errors.As(err, &pqErr):
+		return err
+	case string(pqErr.Code) != code:
+		return fmt.Errorf("@expect-error %s: %s", code, expectationDiff("error "+code, fmt.Sprintf("error %s %s", pqErr.Code, pqErr.Message)))
+	}
+	return nil
+}
+
+// runExpectingError runs a statement that is expected to fail. Inside a transaction, it runs in a savepoint
+// rolled back after the error, so the rest of the transaction can continue.
+func runExpectingError(db queryer, stmt statement, output *resultOutput, code string) error {
+	_, inTransaction := db.(*sql.Tx)
+	if inTransaction {
+		if _, err := db.Exec("SAVEPOINT " + expectErrorSavepoint); err != nil {
+			return fmt.Errorf("failed to create savepoint, error: %s", err)
+		}
+	}
+
+	_, runErr := runSQLStatement(db, stmt, output)
+
+	if inTransaction {
+		if runErr != nil {
+			if _, err := db.Exec("ROLLBACK TO SAVEPOINT " + expectErrorSavepoint); err != nil {
+				return fmt.Errorf("failed to roll back to savepoint, error: %s", err)
+			}
+		}
+		if _, err := db.Exec("RELEASE SAVEPOINT " + expectErrorSavepoint); err != nil {
+			return fmt.Errorf("failed to release savepoint, error: %s", err)
+		}
+	}
+	return checkExpectedError(code, runErr)
+}
+
+// checkExpectations checks the @expect annotations of a statement against its result.
+func checkExpectations(annotations []annotation, rows int64, capture *resultCapture) error {
+	for _, a := range annotations {
+		if a.name != annotationExpect {
+			continue
+		}
+		expectations, err := parseExpectations(a.args)
+		if err != nil {
+			return err
+		}
+		for _, e := range expectations {
+			if err := e.check(rows, capture); err != nil {
+				return fmt.Errorf("@expect %s: %s", a.args, err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+func stringPointer(s string) *string {
+	return &s
+}
+
+func TestParseExpectations(t *testing.T) {
+	tests := []struct {
+		args    string
+		want    []expectation
+		wantErr string
+	}{
+		{args: "rows=0", want: []expectation{{field: "rows", op: "=", rows: 0}}},
+		{args: "rows>=1", want: []expectation{{field: "rows", op: ">=", rows: 1}}},
+		{args: "rows<>3", want: []expectation{{field: "rows", op: "!=", rows: 3}}},
+		{args: "rows<10", want: []expectation{{field: "rows", op: "<", rows: 10}}},
+		{args: "value='ok'", want: []expectation{{field: "value", op: "=", value: stringPointer("ok")}}},
+		{args: "value='it''s ok'", want: []expectation{{field: "value", op: "=", value: stringPointer("it's ok")}}},
+		{args: "value!=5", want: []expectation{{field: "value", op: "!=", value: stringPointer("5")}}},
+		{args: "value=NULL", want: []expectation{{field: "value", op: "="}}},
+		{args: "value=''", want: []expectation{{field: "value", op: "=", value: stringPointer("")}}},
+		{
+			args: "  rows=1   value='a b' ",
+			want: []expectation{{field: "rows", op: "=", rows: 1}, {field: "value", op: "=", value: stringPointer("a b")}},
+		},
+		{args: "", wantErr: "@expect requires a condition, for example: @expect rows=0"},
+		{args: "rows", wantErr: "invalid @expect condition: rows"},
+		{args: "size=1", wantErr: "invalid @expect condition: size=1, expected rows or value"},
+		{args: "value<1", wantErr: "invalid @expect operator for value: <1"},
+		{args: "rows=>1", wantErr: "invalid @expect rows: >1"},
+		{args: "rows=-1", wantErr: "invalid @expect rows: -1"},
+		{args: "rows=", wantErr: "missing @expect value"},
+		{args: "value='ok", wantErr: "unterminated @expect value: 'ok"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.args, func(t *testing.T) {
+			got, err := parseExpectations(tt.args)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("parseExpectations() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseExpectations() error: %s", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseExpectations() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckExpectations(t *testing.T) {
+	row := func(cells ...cell) *resultCapture {
+		return &resultCapture{first: cells, rows: 1}
+	}
+	tests := []struct {
+		name    string
+		args    string
+		rows    int64
+		capture *resultCapture
+		want    string // the diff, empty if the expectation holds
+	}{
+		{name: "rows hold", args: "rows>=1", rows: 2},
+		{name: "rows fail", args: "rows=0", rows: 3, want: "- expected: rows = 0\n+ actual:   rows = 3"},
+		{name: "value holds", args: "value='ok'", rows: 1, capture: row(cell{text: "ok"})},
+		{name: "value fails", args: "value='ok'", rows: 1, capture: row(cell{text: "bad"}), want: "- expected: value = 'ok'\n+ actual:   value = 'bad'"},
+		{name: "not equal value holds", args: "value!='bad'", rows: 1, capture: row(cell{text: "ok"})},
+		{name: "null holds", args: "value=NULL", rows: 1, capture: row(cell{text: "NULL", null: true})},
+		{name: "null marker is not null", args: "value=NULL", rows: 1, capture: row(cell{text: "NULL"}), want: "- expected: value = NULL\n+ actual:   value = 'NULL'"},
+		{name: "value of no rows", args: "value='ok'", capture: &resultCapture{}, want: "- expected: value = 'ok'\n+ actual:   no rows"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkExpectations([]annotation{{annotationExpect, tt.args}}, tt.rows, tt.capture)
+			if tt.want == "" {
+				if err != nil {
+					t.Errorf("checkExpectations() error: %s", err)
+				}
+				return
+			}
+			want := fmt.Sprintf("@expect %s: expectation failed\n%s", tt.args, tt.want)
+			if err == nil || err.Error() != want {
+				t.Errorf("checkExpectations() error = %v, want %q", err, want)
+			}
+		})
+	}
+}
+
+func TestCheckExpectedError(t *testing.T) {
+	var pqErr error = &pq.Error{Code: "23505"}
+	if err := checkExpectedError("23505", fmt.Errorf("failed to execute statement, error: %w", pqErr)); err != nil {
+		t.Errorf("checkExpectedError() error: %s", err)
+	}
+	if err := checkExpectedError("23505", nil); err == nil || !strings.Contains(err.Error(), "+ actual:   statement succeeded") {
+		t.Errorf("checkExpectedError() error = %v, want statement succeeded", err)
+	}
+	err := checkExpectedError("23505", &pq.Error{Code: "42P01", Message: `relation "t" does not exist`})
+	if err == nil || !strings.Contains(err.Error(), `+ actual:   error 42P01 relation "t" does not exist`) {
+		t.Errorf("checkExpectedError() error = %v, want the actual error", err)
+	}
+}
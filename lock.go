@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"hash/fnv"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+const advisoryLockRetryInterval = 2 * time.Second
+
+// advisoryLock is a session level pg_advisory_lock, held on a dedicated connection
+// so concurrent runs against the same database do not interleave.
+type advisoryLock struct {
+	conn *sql.Conn
+	key  int64
+	name string
+}
+
+// advisoryLockKey derives the 64 bit lock key from the database and the lock name.
+func advisoryLockKey(database, name string) int64 {
+	h := fnv.New64a()
+	if _, err := h.Write([]byte(database + "/" + name)); err != nil {
+		panic(err)
+	}
+	return int64(h.Sum64())
+}
+
+// acquireAdvisoryLock waits until the lock is free or the timeout passes.
+// While waiting, it logs the sessions holding the lock.
+func acquireAdvisoryLock(db *sql.DB, database, name string, timeout time.Duration) (*advisoryLock, error) {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get connection for advisory lock, error: %s", err)
+	}
+	lock := &advisoryLock{
+		conn: conn,
+		key:  advisoryLockKey(database, name),
+		name: name,
+	}
+
+	deadline := time.Now().Add(timeout)
+	logged := false
+	for {
+		var acquired bool
+		if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", lock.key).Scan(&acquired); err != nil {
+			lock.closeConn()
+			return nil, fmt.Errorf("failed to acquire advisory lock %s, error: %s", name, err)
+		}
+		if acquired {
+			log.Printf("Acquired advisory lock: %s (key: %d)", name, lock.key)
+			return lock, nil
+		}
+
+		if !logged {
+			log.Warnf("Advisory lock %s is held by another session, waiting up to %s", name, timeout)
+			lock.logHolders(ctx)
+			logged = true
+		}
+		if time.Now().After(deadline) {
+			lock.closeConn()
+			return nil, fmt.Errorf("timed out after %s waiting for advisory lock %s", timeout, name)
+		}
+		time.Sleep(advisoryLockRetryInterval)
+	}
+}
+
+// logHolders logs the sessions holding the lock. A bigint advisory lock key is shown in pg_locks
+// split into classid (high 32 bits) and objid (low 32 bits), with objsubid 1.
+func (l *advisoryLock) logHolders(ctx context.Context) {
+	rows, err := l.conn.QueryContext(ctx, `SELECT a.pid, coalesce(a.usename, ''), coalesce(a.application_name, ''),
+	coalesce(host(a.client_addr), ''), coalesce(a.backend_start::text, ''), coalesce(a.state, '')
+FROM pg_locks l JOIN pg_stat_activity a ON a.pid = l.pid
+WHERE l.locktype = 'advisory' AND l.granted AND l.classid::bigint = $1 AND l.objid::bigint = $2 AND l.objsubid = 1`,
+		int64(uint32(uint64(l.key)>>32)), int64(uint32(uint64(l.key))))
+	if err != nil {
+		log.Warnf("failed to query advisory lock holders, error: %s", err)
+		return
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Warnf("failed to close rows, error: %s", err)
+		}
+	}()
+
+	for rows.Next() {
+		var pid int
+		var user, application, client, started, state string
+		if err := rows.Scan(&pid, &user, &application, &client, &started, &state); err != nil {
+			log.Warnf("failed to scan advisory lock holder, error: %s", err)
+			return
+		}
+		log.Printf("- pid: %d, user: %s, application: %s, client: %s, started: %s, state: %s", pid, user, application, client, started, state)
+	}
+	if err := rows.Err(); err != nil {
+		log.Warnf("failed to read advisory lock holders, error: %s", err)
+	}
+}
+
+// release unlocks the lock and returns its connection to the pool.
+func (l *advisoryLock) release() {
+	var released bool
+	if err := l.conn.QueryRowContext(context.Background(), "SELECT pg_advisory_unlock($1)", l.key).Scan(&released); err != nil {
+		log.Warnf("failed to release advisory lock %s, error: %s", l.name, err)
+	} else if !released {
+		log.Warnf("advisory lock %s was not held", l.name)
+	} else {
+		log.Printf("Released advisory lock: %s", l.name)
+	}
+	l.closeConn()
+}
+
+func (l *advisoryLock) closeConn() {
+	if err := l.conn.Close(); err != nil {
+		log.Warnf("failed to close advisory lock connection, error: %s", err)
+	}
+}
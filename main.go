@@ -4,114 +4,223 @@ import (
 	"database/sql"
 	"fmt"
 	"io/ioutil"
-	"os"
-	"path"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/bitrise-io/go-utils/log"
 	"github.com/bitrise-io/go-utils/pathutil"
 	"github.com/bitrise-tools/go-steputils/stepconf"
-	pg_query "github.com/lfittl/pg_query_go"
 	_ "github.com/lib/pq"
-	"github.com/olekukonko/tablewriter"
 )
 
-type dbInfo struct {
-	host         string
-	port         int
-	username     string
-	password     string
-	databaseName string
-	sslmode      string
-}
-
-func connectToDB(dbInfo dbInfo) (*sql.DB, error) {
-	psqlInfo := fmt.Sprintf("host=%s port=%d user=%s "+
-		"password=%s dbname=%s sslmode=%s",
-		dbInfo.host, dbInfo.port, dbInfo.username,
-		dbInfo.password, dbInfo.databaseName, dbInfo.sslmode)
-	db, err := sql.Open("postgres", psqlInfo)
-	if err != nil {
-		return nil, err
-	}
-
-	err = db.Ping()
-	if err != nil {
-		return nil, err
+// runSQLStatement runs a single statement and returns the number of rows it returned or affected.
+// Result sets are written to the output.
+func runSQLStatement(db queryer, stmt statement, output *resultOutput) (int64, error) {
+	if !returnsRows(stmt.node) {
+		result, err := db.Exec(stmt.text)
+		if err != nil {
+			return 0, fmt.Errorf("failed to execute statement, error: %w", err)
+		}
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return 0, fmt.Errorf("failed to get affected rows, error: %s", err)
+		}
+		return affected, nil
 	}
-	log.Printf("Successfully connected!")
-	return db, nil
-}
 
-func runSQLStatement(db *sql.DB, statement string) error {
-	rows, err := db.Query(statement)
+	rows, err := db.Query(stmt.text)
 	if err != nil {
-		return fmt.Errorf("failed to query statement, error: %s", err)
+		return 0, fmt.Errorf("failed to query statement, error: %w", err)
 	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Warnf("failed to close rows, error: %s", err)
+		}
+	}()
 
+	var count int64
 	for {
 		columnTypes, err := rows.ColumnTypes()
 		if err != nil {
-			return fmt.Errorf("failed to get column types, error: %s", err)
-		}
-		types := []string{}
-		for _, cType := range columnTypes {
-			types = append(types, cType.Name())
+			return 0, fmt.Errorf("failed to get column types, error: %s", err)
 		}
 
-		cols, err := rows.Columns()
+		w, err := output.next()
 		if err != nil {
-			return fmt.Errorf("failed to get columns, error :%s", err)
+			return 0, err
+		}
+		n, err := writeResultSet(w, rows, output.renderer, output.renderer.columns(columnTypes))
+		count += n
+		if err != nil {
+			return count, err
 		}
 
-		allResults := [][]string{}
-
-		// Result is your slice string.
-		rawResult := make([][]byte, len(cols))
-		dest := make([]interface{}, len(cols)) // A temporary interface{} slice
-		for i := range rawResult {
-			dest[i] = &rawResult[i] // Put pointers to each string in the interface slice
+		if !rows.NextResultSet() {
+			break
 		}
+	}
+	return count, nil
+}
 
-		for rows.Next() {
-			err = rows.Scan(dest...)
-			if err != nil {
-				return fmt.Errorf("failed to scan row, error: %s", err)
-			}
+// writeResultSet writes the rows of the current result set as they are scanned and returns the number of rows.
+func writeResultSet(w resultWriter, rows *sql.Rows, r renderer, columns []column) (count int64, err error) {
+	defer func() {
+		if cerr := w.close(); cerr != nil && err == nil {
+			err = fmt.Errorf("failed to write result set, error: %s", cerr)
+		}
+	}()
 
-			result := make([]string, len(cols))
-			for i, raw := range rawResult {
-				if raw == nil {
-					result[i] = ""
-				} else {
-					result[i] = string(raw)
-				}
-			}
+	if err := w.header(columns); err != nil {
+		return 0, fmt.Errorf("failed to write result set, error: %s", err)
+	}
 
-			allResults = append(allResults, result)
+	values := make([]interface{}, len(columns))
+	dest := make([]interface{}, len(columns)) // A temporary interface{} slice
+	for i := range values {
+		dest[i] = &values[i] // Put pointers to each value in the interface slice
+	}
+	cells := make([]cell, len(columns))
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return count, fmt.Errorf("failed to scan row, error: %s", err)
+		}
+		for i, v := range values {
+			cells[i] = r.render(columns[i], v)
+		}
+		if err := w.row(cells); err != nil {
+			return count, fmt.Errorf("failed to write result set, error: %s", err)
 		}
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		return count, fmt.Errorf("failed to read rows, error: %w", err)
+	}
+	return count, nil
+}
 
-		table := tablewriter.NewWriter(os.Stdout)
-		table.SetHeader(types)
-		table.AppendBulk(allResults)
-		table.Render()
-		log.Printf("Rows: %d", len(allResults))
+type config struct {
+	DatabaseURL stepconf.Secret `env:"database_url"`
 
-		if !rows.NextResultSet() {
-			break
-		}
+	DbHost        string          `env:"db_host"`
+	DbPort        int             `env:"db_port"`
+	DbUsername    string          `env:"db_username"`
+	DbPassword    stepconf.Secret `env:"db_password"`
+	DbName        string          `env:"db_name"`
+	DbSSLmode     string          `env:"db_sslmode"`
+	DbSSLRootCert stepconf.Secret `env:"db_sslrootcert"`
+	DbSSLCert     stepconf.Secret `env:"db_sslcert"`
+	DbSSLKey      stepconf.Secret `env:"db_sslkey"`
+	ScriptsDir    string          `env:"scripts_dir"`
+
+	ScriptPatterns string   `env:"script_patterns,required"`
+	ScriptOrdering string   `env:"script_ordering,opt[path,version]"`
+	ManifestPath   string   `env:"manifest_path"`
+	ManifestTags   []string `env:"manifest_tags"`
+	DryRun         bool     `env:"dry_run,opt[yes,no]"`
+
+	MigrationTracking bool   `env:"migration_tracking,opt[yes,no]"`
+	MigrationTable    string `env:"migration_table"`
+	ChecksumAlgorithm string `env:"checksum_algorithm,opt[sha256,fingerprint]"`
+	MigrationRepair   bool   `env:"migration_repair,opt[yes,no]"`
+	TargetVersion     string `env:"target_version"`
+
+	TransactionMode string `env:"transaction_mode,opt[none,script,all]"`
+
+	SeedDir string `env:"seed_dir"`
+
+	Variables        stepconf.Secret `env:"variables"`
+	VariablesFromEnv string          `env:"variables_from_env"`
+
+	StatementTimeout                string `env:"statement_timeout"`
+	LockTimeout                     string `env:"lock_timeout"`
+	IdleInTransactionSessionTimeout string `env:"idle_in_transaction_session_timeout"`
+	SearchPath                      string `env:"search_path"`
+	Role                            string `env:"role"`
+	ApplicationName                 string `env:"application_name"`
+
+	ConnectTimeout int `env:"connect_timeout"`
+	ConnectRetries int `env:"connect_retries"`
+	ConnectBackoff int `env:"connect_backoff"`
+
+	OutputFormat     string `env:"output_format,opt[table,csv,json,jsonl,markdown,html]"`
+	OutputDir        string `env:"output_dir"`
+	MaxRowsDisplayed int    `env:"max_rows_displayed"`
+	NullDisplay      string `env:"null_display"`
+	DisplayTimeZone  string `env:"display_time_zone"`
+	ShowColumnTypes  bool   `env:"show_column_types,opt[yes,no]"`
+
+	AdvisoryLockName    string `env:"advisory_lock_name"`
+	AdvisoryLockTimeout int    `env:"advisory_lock_timeout"`
+}
+
+// hasConnection reports whether any database connection input is set.
+func (c config) hasConnection() bool {
+	return c.DatabaseURL != "" || c.DbHost != "" || c.DbPort != 0 || c.DbUsername != "" || c.DbName != "" || c.DbSSLmode != ""
+}
+
+// validateConnection checks the database connection inputs, which are only optional in dry run mode.
+// If database_url is set, the discrete fields are optional overrides. Retrying needs a backoff,
+// doubling 0 would retry without waiting.
+func (c config) validateConnection() error {
+	if c.ConnectRetries > 0 && c.ConnectBackoff < 1 {
+		return fmt.Errorf("connect_backoff must be at least 1 second when connect_retries is set, got: %d", c.ConnectBackoff)
+	}
+	if c.DatabaseURL != "" {
+		_, err := parseConnectionString(string(c.DatabaseURL))
+		return err
+	}
+
+	var missing []string
+	if c.DbHost == "" {
+		missing = append(missing, "db_host")
+	}
+	if c.DbPort == 0 {
+		missing = append(missing, "db_port")
+	}
+	if c.DbUsername == "" {
+		missing = append(missing, "db_username")
+	}
+	if c.DbName == "" {
+		missing = append(missing, "db_name")
+	}
+	if c.DbSSLmode == "" {
+		missing = append(missing, "db_sslmode")
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("required inputs are not present: %s", strings.Join(missing, ", "))
 	}
 	return nil
 }
 
-type config struct {
-	DbHost     string          `env:"db_host,required"`
-	DbPort     int             `env:"db_port,required"`
-	DbUsername string          `env:"db_username,required"`
-	DbPassword stepconf.Secret `env:"db_password"`
-	DbName     string          `env:"db_name,required"`
-	DbSSLmode  string          `env:"db_sslmode,required"`
-	ScriptsDir string          `env:"scripts_dir,dir"`
+// databaseName returns the default database the scripts run against: db_name, or the one in database_url.
+func (c config) databaseName() string {
+	if c.DbName != "" || c.DatabaseURL == "" {
+		return c.DbName
+	}
+	params, err := parseConnectionString(string(c.DatabaseURL))
+	if err != nil {
+		return ""
+	}
+	return params["dbname"]
+}
+
+type script struct {
+	path       string
+	name       string
+	version    string
+	source     string // file content as read, before variables are substituted
+	content    string
+	validation string // content with \gset variable references replaced by placeholders, so it parses
+	statements []statement
+	commands   []metaCommand
+	sources    []sourceRegion
+	repeatable bool
+
+	database        string
+	transaction     string
+	continueOnError bool
+	rollbackOf      string // name of the applied script a down script rolls back
 }
 
 func main() {
@@ -120,92 +229,337 @@ func main() {
 		panic(fmt.Errorf("could not create config: %s", err))
 	}
 	stepconf.Print(cfg)
-
-	scripsDir, err := pathutil.AbsPath(cfg.ScriptsDir)
-	if err != nil {
-		panic(fmt.Errorf("failed to convert to absolute dir, error: %s", err))
+	if !cfg.DryRun || cfg.hasConnection() {
+		if err := cfg.validateConnection(); err != nil {
+			panic(fmt.Errorf("could not create config: %s", err))
+		}
 	}
-
-	entries, err := ioutil.ReadDir(scripsDir)
+	if cfg.TargetVersion != "" {
+		if err := validateVersion(cfg.TargetVersion); err != nil {
+			panic(fmt.Errorf("could not create config: %s", err))
+		}
+		if !cfg.MigrationTracking {
+			panic("could not create config: target_version requires migration_tracking")
+		}
+	}
+	vars, err := parseVariables(string(cfg.Variables), cfg.VariablesFromEnv)
 	if err != nil {
-		panic(err)
+		panic(fmt.Errorf("could not create config: %s", err))
 	}
-	scriptFiles := []string{}
-	for _, entry := range entries {
-		if !entry.IsDir() && path.Ext(strings.ToLower(entry.Name())) == ".sql" {
-			scriptFiles = append(scriptFiles, path.Join(scripsDir, entry.Name()))
+	var timeZone *time.Location
+	if cfg.DisplayTimeZone != "" {
+		if timeZone, err = time.LoadLocation(cfg.DisplayTimeZone); err != nil {
+			panic(fmt.Errorf("could not create config: invalid display_time_zone: %s", err))
 		}
 	}
-	log.Printf("Script files: %s", scriptFiles)
 
-	// Connect to DB
-	db, err := connectToDB(dbInfo{
-		host:         cfg.DbHost,
-		port:         cfg.DbPort,
-		username:     cfg.DbUsername,
-		password:     string(cfg.DbPassword),
-		sslmode:      cfg.DbSSLmode,
-		databaseName: cfg.DbName,
-	})
-	if err != nil {
-		panic(err)
-	}
-	defer func() {
-		err := db.Close()
+	// Find scripts, listed in the manifest or discovered in the scripts dir
+	var baseDir string
+	var entries []manifestEntry
+	if cfg.ManifestPath != "" {
+		manifestPath, err := pathutil.AbsPath(cfg.ManifestPath)
 		if err != nil {
-			log.Warnf("failed to close DB")
+			panic(fmt.Errorf("failed to convert to absolute path, error: %s", err))
+		}
+		if entries, err = readManifest(manifestPath, cfg.ManifestTags); err != nil {
+			panic(err)
+		}
+		baseDir = filepath.Dir(manifestPath)
+	} else {
+		if err := checkPath(cfg.ScriptsDir, true); err != nil {
+			panic(fmt.Errorf("could not create config: invalid scripts_dir: %s, error: %s", cfg.ScriptsDir, err))
+		}
+		scripsDir, err := pathutil.AbsPath(cfg.ScriptsDir)
+		if err != nil {
+			panic(fmt.Errorf("failed to convert to absolute dir, error: %s", err))
 		}
-	}()
 
-	type script struct {
-		path    string
-		content string
+		include, exclude, err := scriptPatterns(cfg.ScriptPatterns)
+		if err != nil {
+			panic(err)
+		}
+		scriptNames, err := discoverScripts(scripsDir, include, exclude)
+		if err != nil {
+			panic(err)
+		}
+		if cfg.ScriptOrdering == orderingVersion {
+			if scriptNames, err = orderByVersion(scriptNames); err != nil {
+				panic(err)
+			}
+		}
+		scriptNames = repeatablesLast(scriptNames)
+		for _, name := range scriptNames {
+			entries = append(entries, manifestEntry{Path: name})
+		}
+		baseDir = scripsDir
 	}
 
 	// Read script contents
-	scripts := make([]script, len(scriptFiles))
-	for i, path := range scriptFiles {
-		file, err := os.Open(path)
+	scripts := make([]script, len(entries))
+	preprocessedScripts := make([]preprocessed, len(entries))
+	for i, entry := range entries {
+		path := filepath.Join(baseDir, filepath.FromSlash(entry.Path))
+		contents, err := ioutil.ReadFile(path)
 		if err != nil {
-			panic(fmt.Errorf("failed to open file: %s, error: %s", path, err))
+			panic(fmt.Errorf("failed to read content, file: %s, error: %s", path, err))
 		}
 
-		contents, err := ioutil.ReadAll(file)
+		preprocessedScripts[i], err = preprocessScript(path, entry.Path, string(contents), vars)
 		if err != nil {
-			panic(fmt.Errorf("failed to read content, file: %s, error: %s", path, err))
+			panic(fmt.Errorf("failed to preprocess script, error: %s", err))
 		}
 
+		database := entry.Database
+		if database == "" {
+			database = cfg.databaseName()
+		}
 		scripts[i] = script{
-			path:    path,
-			content: string(contents),
+			path:            path,
+			name:            entry.Path,
+			version:         scriptVersion(filepath.Base(path)),
+			repeatable:      isRepeatable(filepath.Base(path)),
+			source:          string(contents),
+			content:         preprocessedScripts[i].content,
+			validation:      preprocessedScripts[i].validation,
+			sources:         preprocessedScripts[i].sources,
+			database:        database,
+			transaction:     entry.Transaction,
+			continueOnError: entry.ContinueOnError,
 		}
 	}
+	log.Printf("Script files: %s", scriptNamesOf(scripts))
 
 	// Validate queries
-	for _, script := range scripts {
-		tree, err := pg_query.ParseToJSON(script.content)
+	for i, script := range scripts {
+		statements, commands, err := preprocessedScripts[i].split()
 		if err != nil {
-			panic(fmt.Errorf("failed to validate script, error: %s, path: %s, content: %s", err, script.path, script.content))
+			panic(fmt.Errorf("failed to validate script, error: %s, path: %s, content: %s", err, script.path, script.source))
+		}
+		gset := map[int]bool{}
+		for _, command := range commands {
+			if command.name == commandGset {
+				gset[command.statement] = true
+			}
+		}
+		for _, stmt := range statements {
+			log.Debugf("%s statement %d (%s): %s", script.name, stmt.index, stmt.lines(), statementType(stmt.node))
+			if err := validateAnnotations(stmt, gset[stmt.index]); err != nil {
+				panic(fmt.Errorf("invalid annotation, script: %s, statement %d (%s), error: %s", script.name, stmt.index, stmt.lines(), err))
+			}
+		}
+		scripts[i].statements = statements
+		scripts[i].commands = commands
+	}
+
+	// Find seed files, loaded after the scripts
+	var seeds []seedFile
+	if cfg.SeedDir != "" {
+		if err := checkPath(cfg.SeedDir, true); err != nil {
+			panic(fmt.Errorf("could not create config: invalid seed_dir: %s, error: %s", cfg.SeedDir, err))
+		}
+		seedDir, err := pathutil.AbsPath(cfg.SeedDir)
+		if err != nil {
+			panic(fmt.Errorf("failed to convert to absolute dir, error: %s", err))
+		}
+		if seeds, err = discoverSeeds(seedDir); err != nil {
+			panic(err)
+		}
+		log.Printf("Seed files: %s", seedNamesOf(seeds))
+	}
+
+	// Separate down scripts, they only run when rolling back to target_version
+	scripts, downScripts, err := splitDownScripts(scripts)
+	if err != nil {
+		panic(err)
+	}
+	if cfg.TargetVersion != "" {
+		for _, script := range scripts {
+			if script.version == "" && !script.repeatable {
+				panic(fmt.Errorf("target_version requires versioned script names, no version in: %s", script.name))
+			}
+		}
+	}
+	if cfg.TransactionMode == transactionAll {
+		if err := checkBatch(scripts); err != nil {
+			panic(err)
+		}
+		if len(seeds) > 0 && len(scripts) > 0 && scripts[0].database != cfg.databaseName() {
+			panic(fmt.Errorf("seed files are loaded into %s, scripts running against %s cannot be in the same transaction with transaction_mode: all", cfg.databaseName(), scripts[0].database))
+		}
+	}
+
+	if cfg.DryRun && !cfg.hasConnection() {
+		log.Warnf("Dry run without database connection, migration history and server version are not checked.")
+		if err := printPlan(scripts, cfg, nil); err != nil {
+			panic(err)
+		}
+		printSeedPlan(seeds)
+		if _, err := nonTransactionalScripts(scripts, nil, cfg.TransactionMode); err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	// Connect to the databases and load their migration history
+	tls, err := prepareTLSFiles(string(cfg.DbSSLRootCert), string(cfg.DbSSLCert), string(cfg.DbSSLKey))
+	if err != nil {
+		panic(err)
+	}
+	defer tls.cleanup()
+
+	databases := databasesOf(scripts)
+	if len(seeds) > 0 && !contains(databases, cfg.databaseName()) {
+		databases = append(databases, cfg.databaseName())
+	}
+	targets := map[string]*target{}
+	for _, database := range databases {
+		t, err := openTarget(cfg, tls, database, scriptsOf(scripts, database))
+		if err != nil {
+			panic(err)
+		}
+		defer t.close()
+		targets[database] = t
+	}
+
+	// Roll back applied scripts above target_version before migrating forward
+	if cfg.TargetVersion != "" {
+		var rollbacks []script
+		for _, database := range databasesOf(scripts) {
+			r, err := rollbackScripts(targets[database], downScripts, cfg.TargetVersion)
+			if err != nil {
+				panic(err)
+			}
+			rollbacks = append(rollbacks, r...)
+		}
+		scripts = append(rollbacks, scripts...)
+	}
+
+	if cfg.DryRun {
+		if err := printPlan(scripts, cfg, targets); err != nil {
+			panic(err)
 		}
-		log.Debugf("%s\n", tree)
+		printSeedPlan(seeds)
+	}
+
+	// Check statements that cannot run inside a transaction block
+	noTransaction, err := nonTransactionalScripts(scripts, targets, cfg.TransactionMode)
+	if err != nil {
+		panic(err)
+	}
+	if cfg.DryRun {
+		return
 	}
 
 	// Execute queries
+	exec := executor{
+		cfg:           cfg,
+		targets:       targets,
+		noTransaction: noTransaction,
+		renderer: renderer{
+			nullDisplay: cfg.NullDisplay,
+			location:    timeZone,
+			showTypes:   cfg.ShowColumnTypes,
+		},
+	}
+	if cfg.TransactionMode == transactionAll && (len(scripts) > 0 || len(seeds) > 0) {
+		database := cfg.databaseName()
+		if len(scripts) > 0 {
+			database = scripts[0].database
+		}
+		if err := exec.begin(database); err != nil {
+			panic(err)
+		}
+	}
+
 	failure := false
 	for _, script := range scripts {
 		fmt.Println()
-		log.Infof("Preparing to run script: %s", path.Base(script.path))
-		log.Printf("Script content:\n%s", script.content)
-
-		err = runSQLStatement(db, script.content)
+		reason, err := targets[script.database].skipReason(script)
 		if err != nil {
-			failure = true
-			log.Warnf("failed to execute, error: %s", err)
+			panic(err)
+		}
+		if reason != "" {
+			log.Printf("Skipping script: %s, %s", script.name, reason)
+			continue
+		}
+		if script.rollbackOf == "" && aboveTarget(script, cfg.TargetVersion) {
+			log.Printf("Skipping script: %s, version %s is above target version %s", script.name, script.version, cfg.TargetVersion)
+			continue
 		}
 
-		log.Infof("Done with script: %s", path.Base(script.path))
+		if script.rollbackOf != "" {
+			log.Infof("Preparing to roll back script: %s, using: %s", script.rollbackOf, script.name)
+		} else {
+			log.Infof("Preparing to run script: %s", script.name)
+		}
+		log.Printf("Script content:\n%s", script.source)
+
+		if !exec.run(script) {
+			if script.continueOnError {
+				log.Warnf("Continuing, script allows errors: %s", script.name)
+			} else {
+				failure = true
+			}
+		}
+
+		log.Infof("Done with script: %s", script.name)
+
+		if failure && (cfg.TransactionMode == transactionAll || script.rollbackOf != "") {
+			break
+		}
+	}
+	if !failure && len(seeds) > 0 {
+		fmt.Println()
+		log.Infof("Loading seed files")
+		if !exec.seed(seeds) {
+			failure = true
+		}
+	}
+	if err := exec.commit(); err != nil {
+		panic(err)
+	}
+	if err := exec.outputs.exportSummary(); err != nil {
+		panic(err)
 	}
 	if failure {
 		panic("One or more scripts failed.")
 	}
 }
+
+// databasesOf returns the databases the scripts run against, in order of first use.
+func databasesOf(scripts []script) []string {
+	var databases []string
+	seen := map[string]bool{}
+	for _, s := range scripts {
+		if !seen[s.database] {
+			seen[s.database] = true
+			databases = append(databases, s.database)
+		}
+	}
+	return databases
+}
+
+func scriptNamesOf(scripts []script) []string {
+	names := make([]string, len(scripts))
+	for i, s := range scripts {
+		names[i] = s.name
+	}
+	return names
+}
+
+func seedNamesOf(seeds []seedFile) []string {
+	var names []string
+	for _, s := range seeds {
+		names = append(names, s.name)
+	}
+	return names
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// manifestEntry is a script listed in the manifest, with its optional attributes.
+type manifestEntry struct {
+	Path            string   `json:"path"`
+	Transaction     string   `json:"transaction"`
+	ContinueOnError bool     `json:"continue_on_error"`
+	Database        string   `json:"database"`
+	Tags            []string `json:"tags"`
+}
+
+// manifest defines the scripts to run and their order, instead of discovering them in scripts_dir.
+type manifest struct {
+	Scripts []manifestEntry `json:"scripts"`
+}
+
+// checkPath validates a path the same way as the stepconf file and dir constraints.
+func checkPath(pth string, dir bool) error {
+	info, err := os.Stat(pth)
+	if err != nil {
+		return os.ErrNotExist
+	}
+	if dir && !info.IsDir() {
+		return errors.New("not a directory")
+	}
+	if !dir && info.IsDir() {
+		return errors.New("not a file")
+	}
+	return nil
+}
+
+// readManifest parses a JSON manifest. Script paths are relative to the manifest's directory.
+// If tags are given, only the entries having any of them are returned.
+func readManifest(pth string, tags []string) ([]manifestEntry, error) {
+	if err := checkPath(pth, false); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %s, error: %s", pth, err)
+	}
+	content, err := ioutil.ReadFile(pth)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %s, error: %s", pth, err)
+	}
+
+	var m manifest
+	if err := json.Unmarshal(content, &m); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest: %s, error: %s", pth, err)
+	}
+
+	dir := filepath.Dir(pth)
+	seen := map[string]bool{}
+	var entries []manifestEntry
+	for i, entry := range m.Scripts {
+		if entry.Path == "" {
+			return nil, fmt.Errorf("manifest entry %d has no path", i+1)
+		}
+		entry.Path = path.Clean(filepath.ToSlash(entry.Path))
+		if seen[entry.Path] {
+			return nil, fmt.Errorf("script listed more than once in manifest: %s", entry.Path)
+		}
+		seen[entry.Path] = true
+
+		if err := checkPath(filepath.Join(dir, filepath.FromSlash(entry.Path)), false); err != nil {
+			return nil, fmt.Errorf("invalid script in manifest: %s, error: %s", entry.Path, err)
+		}
+		switch entry.Transaction {
+		case "", transactionNone, transactionScript:
+		default:
+			return nil, fmt.Errorf("invalid transaction mode of script %s: %s (expected %s or %s)", entry.Path, entry.Transaction, transactionNone, transactionScript)
+		}
+
+		if hasAnyTag(entry.Tags, tags) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// hasAnyTag reports whether an entry has any of the selected tags, ignoring surrounding whitespace
+// on both sides. Without selected tags every entry is selected.
+func hasAnyTag(tags, selected []string) bool {
+	if len(selected) == 0 {
+		return true
+	}
+	for _, tag := range tags {
+		for _, s := range selected {
+			if strings.TrimSpace(s) == strings.TrimSpace(tag) {
+				return true
+			}
+		}
+	}
+	return false
+}
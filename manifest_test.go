@@ -0,0 +1,133 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+	for _, name := range []string{"schema/tables.sql", "seed/users.sql", "views.sql"} {
+		pth := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(pth), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(pth, []byte("SELECT 1;\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "dir.sql"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	scripts := `{"scripts": [
+		{"path": "schema/tables.sql", "tags": ["schema"]},
+		{"path": "./seed/../seed/users.sql", "transaction": "script", "continue_on_error": true, "tags": [" seed"]},
+		{"path": "views.sql", "database": "reporting"}
+	]}`
+
+	tests := []struct {
+		name     string
+		manifest string
+		tags     []string
+		want     []string
+		wantErr  string
+	}{
+		{name: "all entries", manifest: scripts, want: []string{"schema/tables.sql", "seed/users.sql", "views.sql"}},
+		{name: "tags", manifest: scripts, tags: []string{"seed", "schema "}, want: []string{"schema/tables.sql", "seed/users.sql"}},
+		{name: "unknown tag", manifest: scripts, tags: []string{"views"}},
+		{
+			name:     "duplicate",
+			manifest: `{"scripts": [{"path": "views.sql"}, {"path": "./views.sql"}]}`,
+			wantErr:  "script listed more than once in manifest: views.sql",
+		},
+		{
+			name:     "no path",
+			manifest: `{"scripts": [{"path": "views.sql"}, {"tags": ["x"]}]}`,
+			wantErr:  "manifest entry 2 has no path",
+		},
+		{
+			name:     "missing script",
+			manifest: `{"scripts": [{"path": "missing.sql"}]}`,
+			wantErr:  "invalid script in manifest: missing.sql, error: file does not exist",
+		},
+		{
+			name:     "directory",
+			manifest: `{"scripts": [{"path": "dir.sql"}]}`,
+			wantErr:  "invalid script in manifest: dir.sql, error: not a file",
+		},
+		{
+			name:     "invalid transaction",
+			manifest: `{"scripts": [{"path": "views.sql", "transaction": "all"}]}`,
+			wantErr:  "invalid transaction mode of script views.sql: all (expected none or script)",
+		},
+		{
+			name:     "invalid JSON",
+			manifest: `{"scripts": [`,
+			wantErr:  "failed to parse manifest: ",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pth := filepath.Join(dir, "manifest.json")
+			if err := ioutil.WriteFile(pth, []byte(tt.manifest), 0644); err != nil {
+				t.Fatal(err)
+			}
+			entries, err := readManifest(pth, tt.tags)
+			if tt.wantErr != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) {
+					t.Fatalf("readManifest() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readManifest() error: %s", err)
+			}
+			var got []string
+			for _, entry := range entries {
+				got = append(got, entry.Path)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("readManifest() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := readManifest(filepath.Join(dir, "missing.json"), nil); err == nil {
+		t.Errorf("readManifest() expected error for a missing manifest")
+	}
+}
+
+func TestHasAnyTag(t *testing.T) {
+	tests := []struct {
+		tags     []string
+		selected []string
+		want     bool
+	}{
+		{nil, nil, true},
+		{[]string{"seed"}, nil, true},
+		{nil, []string{"seed"}, false},
+		{[]string{"schema", "seed"}, []string{"seed"}, true},
+		{[]string{" seed"}, []string{"seed"}, true},
+		{[]string{"seed"}, []string{" seed "}, true},
+		{[]string{"Seed"}, []string{"seed"}, false},
+		{[]string{"schema"}, []string{"seed", "views"}, false},
+	}
+	for _, tt := range tests {
+		if got := hasAnyTag(tt.tags, tt.selected); got != tt.want {
+			t.Errorf("hasAnyTag(%q, %q) = %t, want %t", tt.tags, tt.selected, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+	pg_query "github.com/lfittl/pg_query_go"
+	"github.com/lib/pq"
+)
+
+// appliedScript is a row of the migration history table.
+type appliedScript struct {
+	name      string
+	version   string
+	checksum  string
+	appliedAt time.Time
+	duration  time.Duration
+	success   bool
+}
+
+// migrationHistory records the scripts run against a database in a history table.
+type migrationHistory struct {
+	db    queryer
+	table string
+}
+
+func newMigrationHistory(db *sql.DB, table string) migrationHistory {
+	return migrationHistory{
+		db:    db,
+		table: quoteQualifiedIdentifier(table),
+	}
+}
+
+// in returns a copy of the history that reads and writes through q, for example inside a transaction.
+func (h migrationHistory) in(q queryer) migrationHistory {
+	return migrationHistory{
+		db:    q,
+		table: h.table,
+	}
+}
+
+// quoteQualifiedIdentifier quotes each part of a (possibly schema qualified) name.
+func quoteQualifiedIdentifier(name string) string {
+	parts := strings.Split(name, ".")
+	for i, part := range parts {
+		parts[i] = pq.QuoteIdentifier(part)
+	}
+	return strings.Join(parts, ".")
+}
+
+func (h migrationHistory) ensureTable() error {
+	_, err := h.db.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	name text PRIMARY KEY,
+	version text NOT NULL DEFAULT '',
+	checksum text NOT NULL,
+	applied_at timestamptz NOT NULL DEFAULT now(),
+	duration_ms bigint NOT NULL,
+	success boolean NOT NULL
+)`, h.table))
+	if err != nil {
+		return fmt.Errorf("failed to create migration history table %s, error: %s", h.table, err)
+	}
+	return nil
+}
+
+// exists reports whether the history table exists, without creating it.
+func (h migrationHistory) exists() (bool, error) {
+	rows, err := h.db.Query("SELECT to_regclass($1) IS NOT NULL", h.table)
+	if err != nil {
+		return false, fmt.Errorf("failed to check migration history table %s, error: %s", h.table, err)
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Warnf("failed to close rows, error: %s", err)
+		}
+	}()
+
+	var exists bool
+	if rows.Next() {
+		if err := rows.Scan(&exists); err != nil {
+			return false, fmt.Errorf("failed to check migration history table %s, error: %s", h.table, err)
+		}
+	}
+	return exists, rows.Err()
+}
+
+func (h migrationHistory) load() (map[string]appliedScript, error) {
+	rows, err := h.db.Query(fmt.Sprintf("SELECT name, version, checksum, applied_at, duration_ms, success FROM %s", h.table))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query migration history, error: %s", err)
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Warnf("failed to close rows, error: %s", err)
+		}
+	}()
+
+	applied := map[string]appliedScript{}
+	for rows.Next() {
+		var s appliedScript
+		var durationMs int64
+		if err := rows.Scan(&s.name, &s.version, &s.checksum, &s.appliedAt, &durationMs, &s.success); err != nil {
+			return nil, fmt.Errorf("failed to scan migration history, error: %s", err)
+		}
+		s.duration = time.Duration(durationMs) * time.Millisecond
+		applied[s.name] = s
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read migration history, error: %s", err)
+	}
+	return applied, nil
+}
+
+func (h migrationHistory) updateChecksum(name, checksum string) error {
+	if _, err := h.db.Exec(fmt.Sprintf("UPDATE %s SET checksum = $1 WHERE name = $2", h.table), checksum, name); err != nil {
+		return fmt.Errorf("failed to update checksum of script %s, error: %s", name, err)
+	}
+	return nil
+}
+
+// remove deletes a script from the history, after it was rolled back.
+func (h migrationHistory) remove(name string) error {
+	if _, err := h.db.Exec(fmt.Sprintf("DELETE FROM %s WHERE name = $1", h.table), name); err != nil {
+		return fmt.Errorf("failed to remove script %s from migration history, error: %s", name, err)
+	}
+	return nil
+}
+
+func (h migrationHistory) record(s appliedScript) error {
+	_, err := h.db.Exec(fmt.Sprintf(`INSERT INTO %s (name, version, checksum, applied_at, duration_ms, success)
+VALUES ($1, $2, $3, now(), $4, $5)
+ON CONFLICT (name) DO UPDATE SET
+	version = EXCLUDED.version,
+	checksum = EXCLUDED.checksum,
+	applied_at = EXCLUDED.applied_at,
+	duration_ms = EXCLUDED.duration_ms,
+	success = EXCLUDED.success`, h.table),
+		s.name, s.version, s.checksum, int64(s.duration/time.Millisecond), s.success)
+	if err != nil {
+		return fmt.Errorf("failed to record script %s in migration history, error: %s", s.name, err)
+	}
+	return nil
+}
+
+const (
+	checksumSHA256      = "sha256"
+	checksumFingerprint = "fingerprint"
+)
+
+// checksum returns the checksum of a script's content, prefixed with the algorithm name.
+// The sha256 algorithm hashes the raw content, while fingerprint uses the pg_query fingerprint
+// of the parse tree, so whitespace and comment edits do not change it. The parse tree is made
+// from the validation content, as \gset variable references do not parse.
+func checksum(algorithm string, s script) (string, error) {
+	switch algorithm {
+	case checksumSHA256:
+		sum := sha256.Sum256([]byte(s.content))
+		return checksumSHA256 + ":" + hex.EncodeToString(sum[:]), nil
+	case checksumFingerprint:
+		fingerprint, err := pg_query.FastFingerprint(s.validation)
+		if err != nil {
+			return "", fmt.Errorf("failed to fingerprint script, error: %s", err)
+		}
+		return checksumFingerprint + ":" + fingerprint, nil
+	default:
+		return "", fmt.Errorf("unknown checksum algorithm: %s", algorithm)
+	}
+}
+
+// checksumMatches compares a stored checksum to the script, using the algorithm the stored checksum was made with.
+func checksumMatches(stored string, s script) (bool, error) {
+	idx := strings.Index(stored, ":")
+	if idx == -1 {
+		return false, fmt.Errorf("invalid stored checksum: %s", stored)
+	}
+	current, err := checksum(stored[:idx], s)
+	if err != nil {
+		return false, err
+	}
+	return current == stored, nil
+}
+
+// driftedScripts returns the successfully applied scripts whose content changed since they were applied.
+// Repeatable scripts are expected to change, they are not checked.
+func driftedScripts(scripts []script, applied map[string]appliedScript) ([]script, error) {
+	var drifted []script
+	for _, s := range scripts {
+		if s.repeatable {
+			continue
+		}
+		previous, ok := applied[s.name]
+		if !ok || !previous.success {
+			continue
+		}
+		match, err := checksumMatches(previous.checksum, s)
+		if err != nil {
+			return nil, fmt.Errorf("failed to verify checksum of script %s, error: %s", s.name, err)
+		}
+		if !match {
+			drifted = append(drifted, s)
+		}
+	}
+	return drifted, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func testScript(t *testing.T, content string) script {
+	t.Helper()
+	pre, err := preprocessScript("test.sql", "test.sql", content, nil)
+	if err != nil {
+		t.Fatalf("preprocessScript() error: %s", err)
+	}
+	return script{name: "test.sql", content: pre.content, validation: pre.validation}
+}
+
+func TestChecksum(t *testing.T) {
+	tests := []struct {
+		name      string
+		algorithm string
+		content   string
+		same      string // content with the same checksum
+		different string // content with a different checksum
+	}{
+		{
+			name:      "sha256",
+			algorithm: checksumSHA256,
+			content:   "SELECT 1;\n",
+			same:      "SELECT 1;\n",
+			different: "SELECT  1;\n",
+		},
+		{
+			name:      "fingerprint ignores whitespace and comments",
+			algorithm: checksumFingerprint,
+			content:   "SELECT 1;\n",
+			same:      "-- comment\nSELECT  1 ;\n",
+			different: "SELECT 1 FROM users;\n",
+		},
+		{
+			name:      "fingerprint with gset variable",
+			algorithm: checksumFingerprint,
+			content:   "SELECT 1 AS a \\gset\nSELECT :a;\n",
+			same:      "SELECT 1 AS a \\gset\nSELECT  :a;\n",
+			different: "SELECT 1 AS a \\gset\nSELECT :a FROM users;\n",
+		},
+		{
+			name:      "sha256 with gset variable",
+			algorithm: checksumSHA256,
+			content:   "SELECT 1 AS a \\gset\nSELECT :a;\n",
+			same:      "SELECT 1 AS a \\gset\nSELECT :a;\n",
+			different: "SELECT 1 AS b \\gset\nSELECT :b;\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sum, err := checksum(tt.algorithm, testScript(t, tt.content))
+			if err != nil {
+				t.Fatalf("checksum() error: %s", err)
+			}
+			if !strings.HasPrefix(sum, tt.algorithm+":") {
+				t.Errorf("checksum() = %s, want %s: prefix", sum, tt.algorithm)
+			}
+
+			if match, err := checksumMatches(sum, testScript(t, tt.same)); err != nil || !match {
+				t.Errorf("checksumMatches(%q) = %t, %v, want true", tt.same, match, err)
+			}
+			if match, err := checksumMatches(sum, testScript(t, tt.different)); err != nil || match {
+				t.Errorf("checksumMatches(%q) = %t, %v, want false", tt.different, match, err)
+			}
+		})
+	}
+}
+
+func TestChecksumMatchesInvalid(t *testing.T) {
+	s := testScript(t, "SELECT 1;\n")
+	for _, stored := range []string{"", "abc", "md5:abc"} {
+		if _, err := checksumMatches(stored, s); err == nil {
+			t.Errorf("checksumMatches(%q) expected error", stored)
+		}
+	}
+}
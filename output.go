@@ -0,0 +1,417 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/log"
+	"github.com/olekukonko/tablewriter"
+)
+
+const (
+	formatTable    = "table"
+	formatCSV      = "csv"
+	formatJSON     = "json"
+	formatJSONL    = "jsonl"
+	formatMarkdown = "markdown"
+	formatHTML     = "html"
+)
+
+// formatExtensions are the file extensions of the result set files.
+var formatExtensions = map[string]string{
+	formatTable:    "txt",
+	formatCSV:      "csv",
+	formatJSON:     "json",
+	formatJSONL:    "jsonl",
+	formatMarkdown: "md",
+	formatHTML:     "html",
+}
+
+// resultWriter writes a result set: the columns, then the rows.
+type resultWriter interface {
+	header(columns []column) error
+	row(cells []cell) error
+	close() error
+}
+
+func newResultWriter(format string, w io.Writer) resultWriter {
+	switch format {
+	case formatCSV:
+		return &csvWriter{w: csv.NewWriter(w)}
+	case formatJSON:
+		return &jsonWriter{w: w}
+	case formatJSONL:
+		return &jsonWriter{w: w, lines: true}
+	case formatMarkdown:
+		return &markdownWriter{w: w}
+	case formatHTML:
+		return &htmlWriter{w: w}
+	default:
+		return &tableWriter{w: w}
+	}
+}
+
+// resultOutput writes the result sets of a script to the log and, if an output dir is set,
+// each one to its own file named after the script: 002_report.sql.resultset-1.csv.
+type resultOutput struct {
+	format   string
+	dir      string
+	script   string
+	maxRows  int // rows printed to the log per result set, 0 prints all
+	renderer renderer
+	outputs  *outputs
+	capture  *resultCapture // records the next result set for the annotations of its statement
+	sets     int
+}
+
+// next returns the writer of the next result set of the script.
+func (o *resultOutput) next() (resultWriter, error) {
+	o.sets++
+	var stdout resultWriter = newResultWriter(o.format, os.Stdout)
+	if o.maxRows > 0 {
+		stdout = &limitedResultWriter{resultWriter: stdout, max: o.maxRows}
+	}
+	writers := multiResultWriter{stdout}
+	if o.capture != nil {
+		writers = append(writers, o.capture)
+		o.capture = nil
+	}
+	if o.dir == "" {
+		return writers, nil
+	}
+
+	pth := filepath.Join(o.dir, filepath.FromSlash(outputName(o.script))) + fmt.Sprintf(".resultset-%d.%s", o.sets, formatExtensions[o.format])
+	if err := os.MkdirAll(filepath.Dir(pth), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create output dir, error: %s", err)
+	}
+	file, err := os.Create(pth)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create result file, error: %s", err)
+	}
+	log.Printf("Writing result set to: %s", pth)
+	return append(writers, fileResultWriter{newResultWriter(o.format, file), file}), nil
+}
+
+// outputName returns the path of a script's result files relative to the output dir. Manifest scripts
+// can be outside the manifest's directory (../shared/report.sql), their .. segments are replaced with __
+// so the files stay in the output dir.
+func outputName(script string) string {
+	segments := strings.Split(strings.TrimLeft(path.Clean(filepath.ToSlash(script)), "/"), "/")
+	for i, segment := range segments {
+		if segment == ".." {
+			segments[i] = "__"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// multiResultWriter writes a result set to each of its writers.
+type multiResultWriter []resultWriter
+
+func (m multiResultWriter) header(columns []column) error {
+	for _, w := range m {
+		if err := w.header(columns); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m multiResultWriter) row(cells []cell) error {
+	for _, w := range m {
+		if err := w.row(cells); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m multiResultWriter) close() error {
+	var first error
+	for _, w := range m {
+		if err := w.close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// limitedResultWriter writes the first max rows of a result set, then a footer with the number of rows left out.
+type limitedResultWriter struct {
+	resultWriter
+	max     int
+	rows    int
+	skipped int
+}
+
+func (l *limitedResultWriter) row(cells []cell) error {
+	l.rows++
+	if l.rows > l.max {
+		l.skipped++
+		return nil
+	}
+	return l.resultWriter.row(cells)
+}
+
+func (l *limitedResultWriter) close() error {
+	if err := l.resultWriter.close(); err != nil {
+		return err
+	}
+	if l.skipped > 0 {
+		log.Printf("... %d more rows", l.skipped)
+	}
+	return nil
+}
+
+// fileResultWriter closes the file after the result set is written.
+type fileResultWriter struct {
+	resultWriter
+	file *os.File
+}
+
+func (f fileResultWriter) close() error {
+	if err := f.resultWriter.close(); err != nil {
+		if cerr := f.file.Close(); cerr != nil {
+			log.Warnf("failed to close file: %s, error: %s", f.file.Name(), cerr)
+		}
+		return err
+	}
+	if err := f.file.Close(); err != nil {
+		return fmt.Errorf("failed to write result file: %s, error: %s", f.file.Name(), err)
+	}
+	return nil
+}
+
+// labels returns the header texts of the columns.
+func labels(columns []column) []string {
+	texts := make([]string, len(columns))
+	for i, c := range columns {
+		texts[i] = c.label
+	}
+	return texts
+}
+
+// texts returns the texts of the cells, NULL is the NULL marker.
+func texts(cells []cell) []string {
+	texts := make([]string, len(cells))
+	for i, c := range cells {
+		texts[i] = c.text
+	}
+	return texts
+}
+
+// tableBatchRows is the number of rows rendered in one ASCII table. Column widths depend on all rows
+// of a table, so rows are rendered in batches instead of buffering the whole result set.
+const tableBatchRows = 100
+
+type tableWriter struct {
+	w       io.Writer
+	columns []string
+	rows    [][]string
+	batches int
+}
+
+func (t *tableWriter) header(columns []column) error {
+	t.columns = labels(columns)
+	return nil
+}
+
+func (t *tableWriter) row(cells []cell) error {
+	t.rows = append(t.rows, texts(cells))
+	if len(t.rows) == tableBatchRows {
+		t.render()
+	}
+	return nil
+}
+
+func (t *tableWriter) render() {
+	table := tablewriter.NewWriter(t.w)
+	table.SetHeader(t.columns)
+	table.AppendBulk(t.rows)
+	table.Render()
+	t.rows = t.rows[:0]
+	t.batches++
+}
+
+func (t *tableWriter) close() error {
+	if len(t.rows) > 0 || t.batches == 0 {
+		t.render()
+	}
+	return nil
+}
+
+type csvWriter struct {
+	w *csv.Writer
+}
+
+func (c *csvWriter) header(columns []column) error {
+	return c.w.Write(labels(columns))
+}
+
+// row writes NULL as an empty value, like COPY TO does in CSV format.
+func (c *csvWriter) row(cells []cell) error {
+	row := make([]string, len(cells))
+	for i, value := range cells {
+		if !value.null {
+			row[i] = value.text
+		}
+	}
+	return c.w.Write(row)
+}
+
+func (c *csvWriter) close() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// jsonWriter writes the rows as objects keyed by column name, in an array or one per line (JSON Lines).
+type jsonWriter struct {
+	w       io.Writer
+	lines   bool
+	columns []column
+	rows    int
+}
+
+func (j *jsonWriter) header(columns []column) error {
+	j.columns = columns
+	return nil
+}
+
+func (j *jsonWriter) row(cells []cell) error {
+	var b strings.Builder
+	b.WriteString("{")
+	for i, value := range cells {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		key, err := marshalJSON(j.columns[i].name)
+		if err != nil {
+			return err
+		}
+		b.Write(key)
+		b.WriteString(":")
+		b.Write(value.json)
+	}
+	b.WriteString("}")
+
+	j.rows++
+	var err error
+	switch {
+	case j.lines:
+		_, err = fmt.Fprintf(j.w, "%s\n", b.String())
+	case j.rows == 1:
+		_, err = fmt.Fprintf(j.w, "[\n  %s", b.String())
+	default:
+		_, err = fmt.Fprintf(j.w, ",\n  %s", b.String())
+	}
+	return err
+}
+
+// marshalJSON encodes a value without escaping HTML characters, the output is not embedded in HTML.
+func marshalJSON(v interface{}) ([]byte, error) {
+	var b bytes.Buffer
+	encoder := json.NewEncoder(&b)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(b.Bytes(), []byte("\n")), nil
+}
+
+func (j *jsonWriter) close() error {
+	if j.lines {
+		return nil
+	}
+	end := "\n]\n"
+	if j.rows == 0 {
+		end = "[]\n"
+	}
+	_, err := io.WriteString(j.w, end)
+	return err
+}
+
+type markdownWriter struct {
+	w io.Writer
+}
+
+// markdownCell escapes the HTML, pipes and line breaks of a table cell.
+func markdownCell(s string) string {
+	s = html.EscapeString(s)
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, "|", `\|`, -1)
+	s = strings.Replace(s, "\r\n", "<br>", -1)
+	return strings.Replace(s, "\n", "<br>", -1)
+}
+
+func (m *markdownWriter) line(cells []string) error {
+	_, err := fmt.Fprintf(m.w, "| %s |\n", strings.Join(cells, " | "))
+	return err
+}
+
+func (m *markdownWriter) header(columns []column) error {
+	cells := make([]string, len(columns))
+	separators := make([]string, len(columns))
+	for i, column := range columns {
+		cells[i] = markdownCell(column.label)
+		separators[i] = "---"
+	}
+	if err := m.line(cells); err != nil {
+		return err
+	}
+	return m.line(separators)
+}
+
+func (m *markdownWriter) row(cells []cell) error {
+	texts := texts(cells)
+	for i, text := range texts {
+		texts[i] = markdownCell(text)
+	}
+	return m.line(texts)
+}
+
+func (m *markdownWriter) close() error {
+	return nil
+}
+
+type htmlWriter struct {
+	w io.Writer
+}
+
+func (h *htmlWriter) cells(tag string, values []string) error {
+	var b strings.Builder
+	b.WriteString("<tr>")
+	for _, value := range values {
+		fmt.Fprintf(&b, "<%s>%s</%s>", tag, html.EscapeString(value), tag)
+	}
+	b.WriteString("</tr>\n")
+	_, err := io.WriteString(h.w, b.String())
+	return err
+}
+
+func (h *htmlWriter) header(columns []column) error {
+	if _, err := io.WriteString(h.w, "<table>\n<thead>\n"); err != nil {
+		return err
+	}
+	if err := h.cells("th", labels(columns)); err != nil {
+		return err
+	}
+	_, err := io.WriteString(h.w, "</thead>\n<tbody>\n")
+	return err
+}
+
+func (h *htmlWriter) row(cells []cell) error {
+	return h.cells("td", texts(cells))
+}
+
+func (h *htmlWriter) close() error {
+	_, err := io.WriteString(h.w, "</tbody>\n</table>\n")
+	return err
+}
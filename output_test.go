@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// writeRows writes a result set with columns a and b.
+func writeRows(w resultWriter, rows [][]interface{}) error {
+	columns := []column{{name: "a", label: "a"}, {name: "b", label: "b"}}
+	if err := w.header(columns); err != nil {
+		return err
+	}
+	r := renderer{nullDisplay: "NULL"}
+	for _, row := range rows {
+		cells := make([]cell, len(row))
+		for i, v := range row {
+			cells[i] = r.render(columns[i], v)
+		}
+		if err := w.row(cells); err != nil {
+			return err
+		}
+	}
+	return w.close()
+}
+
+func TestResultWriters(t *testing.T) {
+	rows := [][]interface{}{
+		{int64(1), "x, \"y\""},
+		{int64(2), nil},
+		{int64(3), "a|b\nc <d> & \\"},
+	}
+	tests := []struct {
+		format string
+		rows   [][]interface{}
+		want   string
+	}{
+		{
+			format: formatCSV,
+			rows:   rows,
+			want:   "a,b\n1,\"x, \"\"y\"\"\"\n2,\n3,\"a|b\nc <d> & \\\"\n",
+		},
+		{
+			format: formatJSON,
+			rows:   rows,
+			want:   "[\n  {\"a\":1,\"b\":\"x, \\\"y\\\"\"},\n  {\"a\":2,\"b\":null},\n  {\"a\":3,\"b\":\"a|b\\nc <d> & \\\\\"}\n]\n",
+		},
+		{
+			format: formatJSON,
+			want:   "[]\n",
+		},
+		{
+			format: formatJSONL,
+			rows:   rows,
+			want:   "{\"a\":1,\"b\":\"x, \\\"y\\\"\"}\n{\"a\":2,\"b\":null}\n{\"a\":3,\"b\":\"a|b\\nc <d> & \\\\\"}\n",
+		},
+		{
+			format: formatJSONL,
+		},
+		{
+			format: formatMarkdown,
+			rows:   rows,
+			want:   "| a | b |\n| --- | --- |\n| 1 | x, &#34;y&#34; |\n| 2 | NULL |\n| 3 | a\\|b<br>c &lt;d&gt; &amp; \\\\ |\n",
+		},
+		{
+			format: formatHTML,
+			rows:   rows,
+			want:   "<table>\n<thead>\n<tr><th>a</th><th>b</th></tr>\n</thead>\n<tbody>\n<tr><td>1</td><td>x, &#34;y&#34;</td></tr>\n<tr><td>2</td><td>NULL</td></tr>\n<tr><td>3</td><td>a|b\nc &lt;d&gt; &amp; \\</td></tr>\n</tbody>\n</table>\n",
+		},
+		{
+			format: formatTable,
+			rows:   [][]interface{}{{int64(1), nil}},
+			want:   "+---+------+\n| A |  B   |\n+---+------+\n| 1 | NULL |\n+---+------+\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			var b bytes.Buffer
+			if err := writeRows(newResultWriter(tt.format, &b), tt.rows); err != nil {
+				t.Fatalf("write error: %s", err)
+			}
+			if got := b.String(); got != tt.want {
+				t.Errorf("%s output = %q, want %q", tt.format, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOutputName(t *testing.T) {
+	tests := []struct {
+		script string
+		want   string
+	}{
+		{"002_report.sql", "002_report.sql"},
+		{"reports/002_report.sql", "reports/002_report.sql"},
+		{"./reports/../002_report.sql", "002_report.sql"},
+		{"../shared/report.sql", "__/shared/report.sql"},
+		{"a/../../../x.sql", "__/__/x.sql"},
+		{"/abs/x.sql", "abs/x.sql"},
+	}
+	for _, tt := range tests {
+		if got := outputName(tt.script); got != tt.want {
+			t.Errorf("outputName(%q) = %q, want %q", tt.script, got, tt.want)
+		}
+	}
+}
+
+func TestResultOutputFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	for _, script := range []string{"reports/002_report.sql", "../shared/report.sql"} {
+		o := &resultOutput{format: formatCSV, dir: filepath.Join(dir, "out"), script: script}
+		for i := 0; i < 2; i++ {
+			w, err := o.next()
+			if err != nil {
+				t.Fatalf("next() error: %s", err)
+			}
+			if err := writeRows(w, [][]interface{}{{int64(i), "x"}}); err != nil {
+				t.Fatalf("write error: %s", err)
+			}
+		}
+	}
+
+	for _, name := range []string{
+		"reports/002_report.sql.resultset-1.csv",
+		"reports/002_report.sql.resultset-2.csv",
+		"__/shared/report.sql.resultset-1.csv",
+		"__/shared/report.sql.resultset-2.csv",
+	} {
+		content, err := ioutil.ReadFile(filepath.Join(dir, "out", filepath.FromSlash(name)))
+		if err != nil {
+			t.Errorf("result file %s: %s", name, err)
+			continue
+		}
+		if len(content) == 0 {
+			t.Errorf("result file %s is empty", name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "shared")); !os.IsNotExist(err) {
+		t.Errorf("result file written outside the output dir")
+	}
+}
+
+// countingDriver is a database/sql driver whose queries return the number of rows given as the query text.
+type countingDriver struct{}
+
+func (countingDriver) Open(string) (driver.Conn, error) { return countingConn{}, nil }
+
+type countingConn struct{}
+
+func (countingConn) Prepare(query string) (driver.Stmt, error) {
+	var n int64
+	if _, err := fmt.Sscan(query, &n); err != nil {
+		return nil, err
+	}
+	return countingStmt(n), nil
+}
+func (countingConn) Close() error              { return nil }
+func (countingConn) Begin() (driver.Tx, error) { return nil, fmt.Errorf("not supported") }
+
+type countingStmt int64
+
+func (countingStmt) Close() error  { return nil }
+func (countingStmt) NumInput() int { return 0 }
+func (countingStmt) Exec([]driver.Value) (driver.Result, error) {
+	return nil, fmt.Errorf("not supported")
+}
+func (s countingStmt) Query([]driver.Value) (driver.Rows, error) {
+	return &countingRows{n: int64(s)}, nil
+}
+
+type countingRows struct {
+	n, i int64
+}
+
+func (*countingRows) Columns() []string { return []string{"a"} }
+func (*countingRows) Close() error      { return nil }
+func (r *countingRows) Next(dest []driver.Value) error {
+	if r.i == r.n {
+		return io.EOF
+	}
+	r.i++
+	dest[0] = r.i
+	return nil
+}
+
+func init() {
+	sql.Register("counting", countingDriver{})
+}
+
+// tableLines counts the header lines and the row lines of ASCII tables with a column a.
+func tableLines(s string) (headers, rows int) {
+	for _, line := range strings.Split(s, "\n") {
+		switch {
+		case !strings.HasPrefix(line, "|"):
+		case strings.Contains(line, " A "):
+			headers++
+		default:
+			rows++
+		}
+	}
+	return headers, rows
+}
+
+func TestLimitedResultWriter(t *testing.T) {
+	db, err := sql.Open("counting", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := db.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	var logged bytes.Buffer
+	log.SetOutWriter(&logged)
+	defer log.SetOutWriter(os.Stdout)
+
+	tests := []struct {
+		rows    int
+		max     int
+		shown   int
+		headers int
+		footer  string
+	}{
+		{rows: 250, max: 0, shown: 250, headers: 3},
+		{rows: 250, max: 120, shown: 120, headers: 2, footer: "... 130 more rows"},
+		{rows: 100, max: 100, shown: 100, headers: 1},
+		{rows: 101, max: 100, shown: 100, headers: 1, footer: "... 1 more rows"},
+		{rows: 0, max: 10, shown: 0, headers: 1},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d rows, max %d", tt.rows, tt.max), func(t *testing.T) {
+			logged.Reset()
+			rows, err := db.Query(fmt.Sprint(tt.rows))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				if err := rows.Close(); err != nil {
+					t.Error(err)
+				}
+			}()
+
+			var b bytes.Buffer
+			var w resultWriter = newResultWriter(formatTable, &b)
+			if tt.max > 0 {
+				w = &limitedResultWriter{resultWriter: w, max: tt.max}
+			}
+			count, err := writeResultSet(w, rows, renderer{}, []column{{name: "a", label: "a"}})
+			if err != nil {
+				t.Fatalf("writeResultSet() error: %s", err)
+			}
+			if count != int64(tt.rows) {
+				t.Errorf("writeResultSet() = %d rows, want %d", count, tt.rows)
+			}
+			headers, shown := tableLines(b.String())
+			if shown != tt.shown || headers != tt.headers {
+				t.Errorf("table shows %d rows under %d headers, want %d rows under %d headers", shown, headers, tt.shown, tt.headers)
+			}
+			if got := strings.TrimSpace(logged.String()); got != tt.footer {
+				t.Errorf("footer = %q, want %q", got, tt.footer)
+			}
+		})
+	}
+}
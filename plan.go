@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/log"
+	nodes "github.com/lfittl/pg_query_go/nodes"
+)
+
+const (
+	categoryDDL      = "DDL"
+	categoryDML      = "DML"
+	categoryReadOnly = "read-only"
+	categoryOther    = "other"
+)
+
+// statementCategory classifies a statement as DDL, DML, read-only or other (for example SET, VACUUM or DO).
+func statementCategory(node nodes.Node) string {
+	switch n := node.(type) {
+	case nodes.SelectStmt:
+		if n.IntoClause != nil {
+			return categoryDDL
+		}
+		if len(n.LockingClause.Items) > 0 {
+			return categoryDML
+		}
+		return categoryReadOnly
+	case nodes.ExplainStmt:
+		for _, option := range n.Options.Items {
+			if def, ok := option.(nodes.DefElem); ok && def.Defname != nil && *def.Defname == "analyze" {
+				return statementCategory(n.Query)
+			}
+		}
+		return categoryReadOnly
+	case nodes.VariableShowStmt, nodes.FetchStmt:
+		return categoryReadOnly
+	case nodes.CopyStmt:
+		if n.IsFrom {
+			return categoryDML
+		}
+		return categoryReadOnly
+	case nodes.InsertStmt, nodes.UpdateStmt, nodes.DeleteStmt, nodes.TruncateStmt, nodes.RefreshMatViewStmt:
+		return categoryDML
+	case nodes.IndexStmt, nodes.ViewStmt, nodes.RuleStmt, nodes.CompositeTypeStmt, nodes.DefineStmt,
+		nodes.GrantStmt, nodes.GrantRoleStmt, nodes.RenameStmt, nodes.CommentStmt, nodes.SecLabelStmt,
+		nodes.ReassignOwnedStmt, nodes.CreatedbStmt:
+		return categoryDDL
+	}
+
+	name := statementType(node)
+	for _, prefix := range []string{"Create", "Alter", "Drop"} {
+		if strings.HasPrefix(name, prefix) {
+			return categoryDDL
+		}
+	}
+	return categoryOther
+}
+
+// printPlan prints the scripts in execution order with their statements, without running anything.
+// Targets are nil if there is no database connection.
+func printPlan(scripts []script, cfg config, targets map[string]*target) error {
+	fmt.Println()
+	log.Infof("Execution plan (dry run):")
+
+	for i, script := range scripts {
+		t := targets[script.database]
+		action := "run"
+		switch {
+		case script.rollbackOf != "":
+			action = fmt.Sprintf("roll back %s", script.rollbackOf)
+		case aboveTarget(script, cfg.TargetVersion):
+			action = fmt.Sprintf("skip, version %s is above target version %s", script.version, cfg.TargetVersion)
+		case !cfg.MigrationTracking:
+		case t == nil:
+			action = "run, migration history not checked"
+		default:
+			reason, err := t.skipReason(script)
+			if err != nil {
+				return err
+			}
+			if reason != "" {
+				action = "skip, " + reason
+			} else if script.repeatable {
+				if _, ok := t.applied[script.name]; ok {
+					action = "run, repeatable script changed"
+				}
+			}
+		}
+		if script.database != cfg.databaseName() {
+			action += fmt.Sprintf(", database: %s", script.database)
+		}
+		log.Printf("%d. %s (%s)", i+1, script.name, action)
+
+		for _, stmt := range script.statements {
+			line := fmt.Sprintf("   #%d %s: %s, %s", stmt.index, stmt.lines(), statementType(stmt.node), statementCategory(stmt.node))
+			if script.transactionMode(cfg.TransactionMode) != transactionNone {
+				if reason := transactionRestriction(stmt.node, t.version()); reason != "" {
+					line += fmt.Sprintf(", cannot run inside a transaction block (%s)", reason)
+				}
+			}
+			log.Printf("%s", line)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,750 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/bitrise-io/go-utils/log"
+	"github.com/bitrise-io/go-utils/pathutil"
+	"github.com/lib/pq"
+)
+
+// Meta-commands that run at execution time, between the statements of a script.
+const (
+	commandEcho = "echo"
+	commandCopy = "copy"
+	commandGset = "gset"
+)
+
+// maxIncludeDepth limits nested \i and \ir commands.
+const maxIncludeDepth = 16
+
+// metaCommand is a psql meta-command that runs at execution time. Echo and copy commands run
+// before the statement with the given index (len(statements)+1 after the last statement),
+// gset runs the statement with the given index and stores its result in variables.
+type metaCommand struct {
+	name      string
+	args      string
+	vars      map[string]string // variables defined at the command, its arguments are substituted at execution time
+	file      string
+	line      int
+	offset    int // byte offset in the preprocessed content
+	statement int
+}
+
+func (c metaCommand) String() string {
+	return fmt.Sprintf(`%s:%d: \%s`, c.file, c.line, c.name)
+}
+
+// variableRef is a reference to a variable that is not defined before execution, because it may be set by \gset.
+type variableRef struct {
+	offset int // byte offset in the preprocessed content
+	length int
+	name   string
+	quote  byte
+}
+
+// sourceRegion maps the lines of the preprocessed content, starting at contentLine, back to the file they come from.
+type sourceRegion struct {
+	contentLine int
+	file        string
+	line        int
+}
+
+// sourceLine returns the file and line a line of the preprocessed content comes from.
+func sourceLine(sources []sourceRegion, line int) (string, int) {
+	for i := len(sources) - 1; i >= 0; i-- {
+		if sources[i].contentLine <= line {
+			return sources[i].file, sources[i].line + line - sources[i].contentLine
+		}
+	}
+	return "", line
+}
+
+// preprocessed is a script after running its preprocessing meta-commands (\set, \if, \i, ...) and substituting variables.
+// Meta-commands are removed from the content, keeping line breaks, \gset is replaced with the semicolon it implies.
+type preprocessed struct {
+	content    string
+	validation string // content with a placeholder for each variableRef, for pg_query validation
+	commands   []metaCommand
+	refs       []variableRef
+	sources    []sourceRegion
+}
+
+// conditional is an \if block.
+type conditional struct {
+	active  bool // the current branch runs
+	done    bool // a branch already ran, or the enclosing block is inactive
+	sawElse bool
+	line    int
+}
+
+type preprocessor struct {
+	vars       map[string]string
+	gset       bool // a \gset was seen, undefined variables may be set by it at execution time
+	pending    bool // the query buffer has content since the last semicolon
+	content    strings.Builder
+	validation strings.Builder
+	line       int
+	out        preprocessed
+	includes   []string
+}
+
+// preprocessScript runs the psql meta-commands of a script and substitutes its variables:
+//
+//	\set name [value ...], \unset name  define variables
+//	\if expr, \elif expr, \else, \endif  conditionally include parts of the script
+//	\i file, \ir file                    include a script, relative to the working dir or to the including script
+//	\echo text                           print text when the script runs
+//	\gset [prefix]                       run the query and store its single row in variables
+//	\copy table FROM 'file' ...          load a local file into a table
+//
+// Variables are referenced psql style (see variableReference). The script starts with the given variables.
+func preprocessScript(pth, name, content string, vars map[string]string) (preprocessed, error) {
+	p := preprocessor{
+		vars: map[string]string{},
+		line: 1,
+	}
+	for k, v := range vars {
+		p.vars[k] = v
+	}
+	if err := p.process(pth, name, content); err != nil {
+		return preprocessed{}, err
+	}
+	p.out.content = p.content.String()
+	p.out.validation = p.validation.String()
+	return p.out, nil
+}
+
+func (p *preprocessor) emit(text, validation string) {
+	p.content.WriteString(text)
+	p.validation.WriteString(validation)
+	p.line += strings.Count(text, "\n")
+}
+
+// emitLineBreaks keeps the line breaks of skipped text, so lines still map to the source file.
+func (p *preprocessor) emitLineBreaks(text string) {
+	breaks := strings.Repeat("\n", strings.Count(text, "\n"))
+	p.emit(breaks, breaks)
+}
+
+func (p *preprocessor) process(pth, name, content string) error {
+	abs, err := filepath.Abs(pth)
+	if err != nil {
+		return err
+	}
+	for _, included := range p.includes {
+		if included == abs {
+			return fmt.Errorf("%s is included recursively", name)
+		}
+	}
+	if len(p.includes) >= maxIncludeDepth {
+		return fmt.Errorf("%s: too many nested includes", name)
+	}
+	p.includes = append(p.includes, abs)
+	defer func() { p.includes = p.includes[:len(p.includes)-1] }()
+
+	p.out.sources = append(p.out.sources, sourceRegion{contentLine: p.line, file: name, line: 1})
+
+	var conditionals []conditional
+	active := func() bool {
+		return len(conditionals) == 0 || conditionals[len(conditionals)-1].active
+	}
+
+	i := 0
+	for i < len(content) {
+		start := i
+		fail := func(format string, v ...interface{}) error {
+			return fmt.Errorf("%s:%d: %s", name, lineAt(content, start), fmt.Sprintf(format, v...))
+		}
+
+		if n := sqlTokenLength(content[i:]); n > 0 {
+			token := content[i : i+n]
+			if active() {
+				p.emit(token, token)
+				if !strings.HasPrefix(token, "--") && !strings.HasPrefix(token, "/*") {
+					p.pending = true
+				}
+			} else {
+				p.emitLineBreaks(token)
+			}
+			i += n
+			continue
+		}
+
+		switch c := content[i]; {
+		case c == '\\':
+			line := lineAt(content, i)
+			end := strings.IndexByte(content[i:], '\n')
+			if end == -1 {
+				end = len(content)
+			} else {
+				end += i
+			}
+			command, args := splitMetaCommand(content[i+1 : end])
+			i = end
+
+			switch command {
+			case "if", "elif", "else", "endif":
+				if err := p.conditional(command, args, active(), &conditionals, line); err != nil {
+					return fail("%s", err)
+				}
+				continue
+			}
+			if !active() {
+				continue
+			}
+
+			switch command {
+			case "set", "unset":
+				if err := p.set(command, args); err != nil {
+					return fail("%s", err)
+				}
+			case "i", "include", "ir", "include_relative":
+				parts, err := parseMetaArgs(args, p.vars)
+				if err != nil {
+					return fail("%s", err)
+				}
+				if len(parts) != 1 {
+					return fail(`\%s requires a file name`, command)
+				}
+				if err := p.include(pth, name, parts[0], command == "ir" || command == "include_relative"); err != nil {
+					return fail("%s", err)
+				}
+				// Continue the including script on its next line.
+				if i < len(content) {
+					i++
+				}
+				p.out.sources = append(p.out.sources, sourceRegion{contentLine: p.line, file: name, line: line + 1})
+			case commandEcho:
+				// Arguments referencing variables set by \gset can only be checked at execution time.
+				if !p.gset {
+					if _, err := parseMetaArgs(args, p.vars); err != nil {
+						return fail("%s", err)
+					}
+				}
+				p.command(commandEcho, args, name, line)
+			case commandCopy:
+				// Like psql, \copy takes the rest of the line as is, without substituting variables.
+				if _, err := parseCopyCommand(args); err != nil {
+					return fail("%s", err)
+				}
+				p.command(commandCopy, args, name, line)
+			case commandGset:
+				if !p.pending {
+					return fail(`\gset requires a query before it`)
+				}
+				parts, err := parseMetaArgs(args, p.vars)
+				if err != nil {
+					return fail("%s", err)
+				}
+				if len(parts) > 1 {
+					return fail(`\gset takes at most one prefix`)
+				}
+				prefix := strings.Join(parts, "")
+				p.out.commands = append(p.out.commands, metaCommand{name: commandGset, args: prefix, file: name, line: line, offset: p.content.Len()})
+				p.emit(";", ";")
+				p.pending = false
+				p.gset = true
+			case "timing", "pset", "x", "a", "t", "H", "encoding":
+				log.Warnf("%s:%d: ignoring psql meta-command \\%s, it only affects psql output", name, line, command)
+			default:
+				return fail(`unsupported psql meta-command \%s`, command)
+			}
+
+		case !active():
+			if c == '\n' {
+				p.emit("\n", "\n")
+			}
+			i++
+
+		case c == ':':
+			n, ref, quote := variableReference(content[i:])
+			if n == 0 {
+				p.emit(":", ":")
+				i++
+				continue
+			}
+			text := content[i : i+n]
+			if value, ok := p.vars[ref]; ok {
+				value = quoteVariable(value, quote)
+				p.emit(value, value)
+			} else if p.gset {
+				p.out.refs = append(p.out.refs, variableRef{offset: p.content.Len(), length: n, name: ref, quote: quote})
+				p.emit(text, variablePlaceholder(n, quote))
+			} else {
+				return fail("variable %s is not defined", ref)
+			}
+			p.pending = true
+			i += n
+
+		default:
+			p.emit(content[i:i+1], content[i:i+1])
+			if c == ';' {
+				p.pending = false
+			} else if !unicode.IsSpace(rune(c)) {
+				p.pending = true
+			}
+			i++
+		}
+	}
+
+	if len(conditionals) > 0 {
+		return fmt.Errorf(`%s:%d: \if without \endif`, name, conditionals[len(conditionals)-1].line)
+	}
+	return nil
+}
+
+// splitMetaCommand splits the text after a backslash into the command name and its arguments.
+func splitMetaCommand(text string) (string, string) {
+	text = strings.TrimRight(text, "\r")
+	end := strings.IndexFunc(text, unicode.IsSpace)
+	if end == -1 {
+		return text, ""
+	}
+	return text[:end], strings.TrimSpace(text[end:])
+}
+
+func (p *preprocessor) conditional(command, args string, active bool, conditionals *[]conditional, line int) error {
+	stack := *conditionals
+	if command != "if" && len(stack) == 0 {
+		return fmt.Errorf(`\%s without \if`, command)
+	}
+
+	switch command {
+	case "if":
+		if !active {
+			*conditionals = append(stack, conditional{done: true, line: line})
+			return nil
+		}
+		value, err := p.condition(args)
+		if err != nil {
+			return err
+		}
+		*conditionals = append(stack, conditional{active: value, done: value, line: line})
+	case "elif":
+		top := &stack[len(stack)-1]
+		if top.sawElse {
+			return fmt.Errorf(`\elif after \else`)
+		}
+		top.active = false
+		if !top.done {
+			value, err := p.condition(args)
+			if err != nil {
+				return err
+			}
+			top.active, top.done = value, value
+		}
+	case "else":
+		top := &stack[len(stack)-1]
+		if top.sawElse {
+			return fmt.Errorf(`\else after \else`)
+		}
+		top.active, top.done, top.sawElse = !top.done, true, true
+	case "endif":
+		*conditionals = stack[:len(stack)-1]
+	}
+	return nil
+}
+
+// condition evaluates the expression of \if and \elif, a boolean value the way psql accepts it.
+func (p *preprocessor) condition(args string) (bool, error) {
+	parts, err := parseMetaArgs(args, p.vars)
+	if err != nil {
+		return false, err
+	}
+	if len(parts) != 1 {
+		return false, fmt.Errorf("boolean expression expected: %s", args)
+	}
+	value, ok := parsePsqlBool(parts[0])
+	if !ok {
+		return false, fmt.Errorf("unrecognized value %q for \\if expression: boolean expected", parts[0])
+	}
+	return value, nil
+}
+
+// parsePsqlBool parses true, false, yes, no (or a prefix of them), on, off, 1 and 0, ignoring case.
+func parsePsqlBool(value string) (bool, bool) {
+	value = strings.ToLower(value)
+	switch {
+	case value == "":
+		return false, false
+	case strings.HasPrefix("true", value), strings.HasPrefix("yes", value), value == "on", value == "1":
+		return true, true
+	case strings.HasPrefix("false", value), strings.HasPrefix("no", value), value == "off", value == "0":
+		return false, true
+	}
+	return false, false
+}
+
+func (p *preprocessor) set(command, args string) error {
+	parts, err := parseMetaArgs(args, p.vars)
+	if err != nil {
+		return err
+	}
+	if len(parts) == 0 {
+		return fmt.Errorf(`\%s requires a variable name`, command)
+	}
+	if !variableNamePattern.MatchString(parts[0]) {
+		return fmt.Errorf("invalid variable name: %s", parts[0])
+	}
+	if command == "unset" {
+		if len(parts) > 1 {
+			return fmt.Errorf(`\unset takes a single variable name`)
+		}
+		delete(p.vars, parts[0])
+		return nil
+	}
+	p.vars[parts[0]] = strings.Join(parts[1:], "")
+	return nil
+}
+
+// command records a meta-command that runs at execution time, with the variables defined at it.
+func (p *preprocessor) command(name, args, file string, line int) {
+	vars := map[string]string{}
+	for k, v := range p.vars {
+		vars[k] = v
+	}
+	p.out.commands = append(p.out.commands, metaCommand{name: name, args: args, vars: vars, file: file, line: line, offset: p.content.Len()})
+}
+
+func (p *preprocessor) include(pth, name, file string, relative bool) error {
+	var includePath, includeName string
+	if relative {
+		includePath = filepath.Join(filepath.Dir(pth), filepath.FromSlash(file))
+		includeName = path.Join(path.Dir(name), filepath.ToSlash(file))
+	} else {
+		var err error
+		if includePath, err = pathutil.AbsPath(file); err != nil {
+			return err
+		}
+		includeName = filepath.ToSlash(file)
+	}
+
+	content, err := ioutil.ReadFile(includePath)
+	if err != nil {
+		return fmt.Errorf("failed to read included file: %s, error: %s", includePath, err)
+	}
+
+	// Start the included script on its own line.
+	if s := p.content.String(); s != "" && !strings.HasSuffix(s, "\n") {
+		p.emit("\n", "\n")
+	}
+	if err := p.process(includePath, includeName, string(content)); err != nil {
+		return err
+	}
+	if !strings.HasSuffix(p.content.String(), "\n") {
+		p.emit("\n", "\n")
+	}
+	return nil
+}
+
+// parseMetaArgs splits the arguments of a meta-command the way psql does: 'quoted' text is unquoted
+// (a doubled quote or \' is a quote, \n and \t are line breaks and tabs), "quoted" text is kept with its quotes
+// and variable references are substituted. Adjacent pieces form a single argument.
+func parseMetaArgs(args string, vars map[string]string) ([]string, error) {
+	var parts []string
+	var b strings.Builder
+	inArg := false
+	flush := func() {
+		if inArg {
+			parts = append(parts, b.String())
+			b.Reset()
+			inArg = false
+		}
+	}
+
+	for i := 0; i < len(args); {
+		c := args[i]
+		switch {
+		case unicode.IsSpace(rune(c)):
+			flush()
+			i++
+			continue
+		case c == '`':
+			return nil, fmt.Errorf("backquoted shell commands are not supported")
+		case c == '\'':
+			n, value, err := unquoteMetaArg(args[i:])
+			if err != nil {
+				return nil, err
+			}
+			b.WriteString(value)
+			i += n
+		case c == '"':
+			n := quotedLength(args[i:], '"', false)
+			b.WriteString(args[i : i+n])
+			i += n
+		case c == ':':
+			n, name, quote := variableReference(args[i:])
+			if n == 0 {
+				b.WriteByte(c)
+				i++
+				break
+			}
+			value, ok := vars[name]
+			if !ok {
+				return nil, fmt.Errorf("variable %s is not defined", name)
+			}
+			b.WriteString(quoteVariable(value, quote))
+			i += n
+		default:
+			b.WriteByte(c)
+			i++
+		}
+		inArg = true
+	}
+	flush()
+	return parts, nil
+}
+
+// unquoteMetaArg unquotes the single quoted meta-command argument at the start of s.
+func unquoteMetaArg(s string) (int, string, error) {
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\'':
+			if i+1 < len(s) && s[i+1] == '\'' {
+				b.WriteByte('\'')
+				i++
+				continue
+			}
+			return i + 1, b.String(), nil
+		case '\\':
+			if i+1 == len(s) {
+				break
+			}
+			i++
+			switch s[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'r':
+				b.WriteByte('\r')
+			default:
+				b.WriteByte(s[i])
+			}
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return 0, "", fmt.Errorf("unterminated quoted string: %s", s)
+}
+
+// quoteVariable returns the value of a variable reference, quoted as a literal or an identifier if requested.
+func quoteVariable(value string, quote byte) string {
+	switch quote {
+	case '\'':
+		return quoteLiteral(value)
+	case '"':
+		return pq.QuoteIdentifier(value)
+	default:
+		return value
+	}
+}
+
+// variablePlaceholder returns a valid value of the same length as a reference, so statement offsets
+// in the validated content match the preprocessed content.
+func variablePlaceholder(length int, quote byte) string {
+	switch quote {
+	case '\'', '"':
+		return string(quote) + strings.Repeat("x", length-2) + string(quote)
+	default:
+		return "0" + strings.Repeat(" ", length-1)
+	}
+}
+
+// split validates the preprocessed content and splits it into statements. It attaches the
+// meta-commands to the statements they run before (or with, for \gset).
+func (p preprocessed) split() ([]statement, []metaCommand, error) {
+	statements, err := splitStatements(p.validation)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	top := ""
+	if len(p.sources) > 0 {
+		top = p.sources[0].file
+	}
+	for i, stmt := range statements {
+		end := stmt.offset + len(stmt.text)
+		for _, ref := range p.refs {
+			// The padding of a placeholder at the end of a statement is trimmed as whitespace.
+			if ref.offset < end && ref.offset+ref.length > end {
+				end = ref.offset + ref.length
+			}
+		}
+		stmt.text = p.content[stmt.offset:end]
+		for _, ref := range p.refs {
+			if ref.offset >= stmt.offset && ref.offset < end {
+				stmt.refs = append(stmt.refs, ref)
+			}
+		}
+		file, startLine := sourceLine(p.sources, stmt.startLine)
+		_, endLine := sourceLine(p.sources, stmt.endLine)
+		if file != top {
+			stmt.file = file
+		}
+		stmt.startLine, stmt.endLine = startLine, endLine
+		statements[i] = stmt
+	}
+
+	commands := make([]metaCommand, len(p.commands))
+	for i, command := range p.commands {
+		if command.name == commandGset {
+			for _, stmt := range statements {
+				if stmt.offset+len(stmt.text) <= command.offset {
+					command.statement = stmt.index
+				}
+			}
+			if command.statement == 0 {
+				return nil, nil, fmt.Errorf(`%s requires a query before it`, command)
+			}
+		} else {
+			command.statement = len(statements) + 1
+			for j := len(statements) - 1; j >= 0; j-- {
+				if statements[j].offset+len(statements[j].text) > command.offset {
+					command.statement = statements[j].index
+				}
+			}
+		}
+		commands[i] = command
+	}
+	return statements, commands, nil
+}
+
+// substitute returns the text of a statement with the variables set by \gset substituted.
+func (s statement) substitute(vars map[string]string) (string, error) {
+	if len(s.refs) == 0 {
+		return s.text, nil
+	}
+
+	var b strings.Builder
+	last := 0
+	for _, ref := range s.refs {
+		value, ok := vars[ref.name]
+		if !ok {
+			return "", fmt.Errorf("variable %s is not defined", ref.name)
+		}
+		start := ref.offset - s.offset
+		b.WriteString(s.text[last:start])
+		b.WriteString(quoteVariable(value, ref.quote))
+		last = start + ref.length
+	}
+	b.WriteString(s.text[last:])
+	return b.String(), nil
+}
+
+// unsubstitutedOffset maps a byte offset in the text returned by substitute back to the statement text.
+// An offset inside a substituted value maps to the start of its variable reference.
+func (s statement) unsubstitutedOffset(offset int, vars map[string]string) int {
+	shift := 0
+	for _, ref := range s.refs {
+		start := ref.offset - s.offset
+		length := len(quoteVariable(vars[ref.name], ref.quote))
+		switch {
+		case offset < start+shift:
+			return offset - shift
+		case offset < start+shift+length:
+			return start
+		}
+		shift += length - ref.length
+	}
+	return offset - shift
+}
+
+// runCommand runs an \echo or \copy meta-command. Variables set by \gset override the ones defined at the command.
+func runCommand(db queryer, command metaCommand, gsetVars map[string]string) error {
+	vars := map[string]string{}
+	for k, v := range command.vars {
+		vars[k] = v
+	}
+	for k, v := range gsetVars {
+		vars[k] = v
+	}
+
+	switch command.name {
+	case commandEcho:
+		parts, err := parseMetaArgs(command.args, vars)
+		if err != nil {
+			return fmt.Errorf("%s: %s", command, err)
+		}
+		if len(parts) > 0 && parts[0] == "-n" {
+			parts = parts[1:]
+		}
+		log.Printf("%s", strings.Join(parts, " "))
+	case commandCopy:
+		copyCommand, err := parseCopyCommand(command.args)
+		if err != nil {
+			return fmt.Errorf("%s: %s", command, err)
+		}
+		startTime := time.Now()
+		rows, err := copyFrom(db, copyCommand)
+		if err != nil {
+			return fmt.Errorf("%s: %s", command, err)
+		}
+		log.Printf("Copied %d rows into %s from %s, duration: %s", rows, copyCommand.table, copyCommand.file, time.Since(startTime))
+	}
+	return nil
+}
+
+// runGset runs the query of a \gset and stores the columns of its single row in variables, a NULL value unsets the variable.
+func runGset(db queryer, query, prefix string, vars map[string]string) error {
+	rows, err := db.Query(query)
+	if err != nil {
+		return fmt.Errorf("failed to query statement, error: %w", err)
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Warnf("failed to close rows, error: %s", err)
+		}
+	}()
+
+	cols, err := rows.Columns()
+	if err != nil {
+		return fmt.Errorf("failed to get columns, error :%s", err)
+	}
+	values := make([]*string, len(cols))
+	dest := make([]interface{}, len(cols))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+
+	count := 0
+	for rows.Next() {
+		if count++; count > 1 {
+			continue
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return fmt.Errorf("failed to scan row, error: %s", err)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read rows, error: %w", err)
+	}
+	if count == 0 {
+		return fmt.Errorf(`no rows returned for \gset`)
+	}
+	if count > 1 {
+		return fmt.Errorf(`more than one row returned for \gset`)
+	}
+
+	for i, col := range cols {
+		name := prefix + col
+		if !variableNamePattern.MatchString(name) {
+			return fmt.Errorf(`invalid variable name for \gset: %s`, name)
+		}
+		if values[i] == nil {
+			delete(vars, name)
+		} else {
+			vars[name] = *values[i]
+		}
+		log.Debugf("Set variable %s", name)
+	}
+	return nil
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestPreprocessScript(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		vars     map[string]string
+		want     string
+		wantVal  string // validation content, if it differs from the content
+		commands []string
+		wantErr  string
+	}{
+		{
+			name:    "set and reference",
+			content: "\\set schema app\nSELECT * FROM :\"schema\".t;\n",
+			want:    "\nSELECT * FROM \"app\".t;\n",
+		},
+		{
+			name:    "set joins its values",
+			content: "\\set name 'a b' c\nSELECT :'name';\n",
+			want:    "\nSELECT 'a bc';\n",
+		},
+		{
+			name:    "set overrides the given variables",
+			content: "SELECT :n;\n\\set n 2\nSELECT :n;\n",
+			vars:    map[string]string{"n": "1"},
+			want:    "SELECT 1;\n\nSELECT 2;\n",
+		},
+		{
+			name:    "unset",
+			content: "\\set a 1\n\\unset a\nSELECT :a;\n",
+			wantErr: "t.sql:3: variable a is not defined",
+		},
+		{
+			name:    "if branch",
+			content: "\\set on true\n\\if :on\nSELECT 1;\n\\elif true\nSELECT 2;\n\\else\nSELECT 3;\n\\endif\n",
+			want:    "\n\nSELECT 1;\n\n\n\n\n\n",
+		},
+		{
+			name:    "elif branch after a nested if in an inactive branch",
+			content: "\\if false\n\\if true\nSELECT 1;\n\\endif\n\\elif yes\nSELECT 2;\n\\endif\n",
+			want:    "\n\n\n\n\nSELECT 2;\n\n",
+		},
+		{
+			name:    "else branch",
+			content: "\\if off\nSELECT 1;\n\\else\nSELECT 2;\n\\endif\n",
+			want:    "\n\n\nSELECT 2;\n\n",
+		},
+		{
+			name:    "inactive branches are not substituted",
+			content: "\\if 0\nSELECT :missing;\n\\endif\n",
+			want:    "\n\n\n",
+		},
+		{
+			name:    "if without endif",
+			content: "\\if true\nSELECT 1;\n",
+			wantErr: "t.sql:1: \\if without \\endif",
+		},
+		{
+			name:    "else without if",
+			content: "\\else\n",
+			wantErr: "t.sql:1: \\else without \\if",
+		},
+		{
+			name:    "else after else",
+			content: "\\if true\n\\else\n\\else\n\\endif\n",
+			wantErr: "t.sql:3: \\else after \\else",
+		},
+		{
+			name:    "if without boolean",
+			content: "\\if maybe\n\\endif\n",
+			wantErr: "t.sql:1: unrecognized value \"maybe\" for \\if expression: boolean expected",
+		},
+		{
+			name:    "unsupported meta-command",
+			content: "\\foo\n",
+			wantErr: "t.sql:1: unsupported psql meta-command \\foo",
+		},
+		{
+			name:    "output meta-commands are ignored",
+			content: "\\timing on\n\\pset format csv\nSELECT 1;\n",
+			want:    "\n\nSELECT 1;\n",
+		},
+		{
+			name:     "gset",
+			content:  "SELECT 1 AS a \\gset\nSELECT :a;\n",
+			want:     "SELECT 1 AS a ;\nSELECT :a;\n",
+			wantVal:  "SELECT 1 AS a ;\nSELECT 0 ;\n",
+			commands: []string{"gset"},
+		},
+		{
+			name:     "echo and copy",
+			content:  "\\echo loading\n\\copy t (a, b) FROM 'x.csv' CSV HEADER\nSELECT 1;\n",
+			want:     "\n\nSELECT 1;\n",
+			commands: []string{"echo", "copy"},
+		},
+		{
+			name:    "backslashes in quoted strings are not meta-commands",
+			content: "SELECT E'\\\\n', '\\x';\n",
+			want:    "SELECT E'\\\\n', '\\x';\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := preprocessScript("t.sql", "t.sql", tt.content, tt.vars)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("preprocessScript() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("preprocessScript() error: %s", err)
+			}
+			if got.content != tt.want {
+				t.Errorf("preprocessScript() content = %q, want %q", got.content, tt.want)
+			}
+			wantVal := tt.wantVal
+			if wantVal == "" {
+				wantVal = tt.want
+			}
+			if got.validation != wantVal {
+				t.Errorf("preprocessScript() validation = %q, want %q", got.validation, wantVal)
+			}
+			var commands []string
+			for _, command := range got.commands {
+				commands = append(commands, command.name)
+			}
+			if !reflect.DeepEqual(commands, tt.commands) {
+				t.Errorf("preprocessScript() commands = %v, want %v", commands, tt.commands)
+			}
+		})
+	}
+}
+
+func TestPreprocessInclude(t *testing.T) {
+	dir, err := ioutil.TempDir("", "psql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	files := map[string]string{
+		"main.sql":          "SELECT 1;\n\\ir schema/tables.sql\nSELECT 3;\n",
+		"schema/tables.sql": "-- tables\nSELECT :n;\n",
+		"loop.sql":          "\\ir loop.sql\n",
+	}
+	for name, content := range files {
+		pth := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(pth), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(pth, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := preprocessScript(filepath.Join(dir, "main.sql"), "main.sql", files["main.sql"], map[string]string{"n": "2"})
+	if err != nil {
+		t.Fatalf("preprocessScript() error: %s", err)
+	}
+	if want := "SELECT 1;\n-- tables\nSELECT 2;\nSELECT 3;\n"; got.content != want {
+		t.Errorf("preprocessScript() content = %q, want %q", got.content, want)
+	}
+
+	for _, tt := range []struct {
+		line int
+		file string
+		want int
+	}{
+		{1, "main.sql", 1},
+		{2, "schema/tables.sql", 1},
+		{3, "schema/tables.sql", 2},
+		{4, "main.sql", 3},
+	} {
+		if file, line := sourceLine(got.sources, tt.line); file != tt.file || line != tt.want {
+			t.Errorf("sourceLine(%d) = %s:%d, want %s:%d", tt.line, file, line, tt.file, tt.want)
+		}
+	}
+
+	if _, err := preprocessScript(filepath.Join(dir, "loop.sql"), "loop.sql", files["loop.sql"], nil); err == nil {
+		t.Errorf("preprocessScript() expected error for a recursive include")
+	}
+}
+
+func TestSplitCommands(t *testing.T) {
+	pre, err := preprocessScript("t.sql", "t.sql", "SELECT 1 AS a \\gset p_\n\\echo :p_a\nSELECT :p_a;\n\\echo done\n", nil)
+	if err != nil {
+		t.Fatalf("preprocessScript() error: %s", err)
+	}
+	statements, commands, err := pre.split()
+	if err != nil {
+		t.Fatalf("split() error: %s", err)
+	}
+	if len(statements) != 2 {
+		t.Fatalf("split() returned %d statements, want 2", len(statements))
+	}
+
+	// gset runs the statement before it, other commands run before the next statement.
+	want := map[string][]int{"gset": {1}, "echo": {2, 3}}
+	got := map[string][]int{}
+	for _, command := range commands {
+		got[command.name] = append(got[command.name], command.statement)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("split() command statements = %v, want %v", got, want)
+	}
+
+	text, err := statements[1].substitute(map[string]string{"p_a": "it's"})
+	if err != nil {
+		t.Fatalf("substitute() error: %s", err)
+	}
+	if want := "SELECT it's"; text != want {
+		t.Errorf("substitute() = %q, want %q", text, want)
+	}
+	if _, err := statements[1].substitute(nil); err == nil || err.Error() != "variable p_a is not defined" {
+		t.Errorf("substitute() error = %v, want variable p_a is not defined", err)
+	}
+}
+
+func TestParseMetaArgs(t *testing.T) {
+	vars := map[string]string{"v": "x y"}
+	tests := []struct {
+		args    string
+		want    []string
+		wantErr string
+	}{
+		{args: "", want: nil},
+		{args: "a  b", want: []string{"a", "b"}},
+		{args: "'it''s' x", want: []string{"it's", "x"}},
+		{args: `'it\'s'`, want: []string{"it's"}},
+		{args: `'a\nb\tc'`, want: []string{"a\nb\tc"}},
+		{args: `"q" x`, want: []string{`"q"`, "x"}},
+		{args: `a'b'c`, want: []string{"abc"}},
+		{args: `:v :'v' :"v"`, want: []string{"x y", "'x y'", `"x y"`}},
+		{args: "'open", wantErr: "unterminated quoted string: 'open"},
+		{args: ":missing", wantErr: "variable missing is not defined"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.args, func(t *testing.T) {
+			got, err := parseMetaArgs(tt.args, vars)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("parseMetaArgs() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseMetaArgs() error: %s", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseMetaArgs() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParsePsqlBool(t *testing.T) {
+	tests := []struct {
+		value string
+		want  bool
+		ok    bool
+	}{
+		{"true", true, true},
+		{"T", true, true},
+		{"yes", true, true},
+		{"on", true, true},
+		{"1", true, true},
+		{"false", false, true},
+		{"f", false, true},
+		{"NO", false, true},
+		{"off", false, true},
+		{"0", false, true},
+		{"o", false, false},
+		{"", false, false},
+		{"maybe", false, false},
+	}
+	for _, tt := range tests {
+		if got, ok := parsePsqlBool(tt.value); got != tt.want || ok != tt.ok {
+			t.Errorf("parsePsqlBool(%q) = %t, %t, want %t, %t", tt.value, got, ok, tt.want, tt.ok)
+		}
+	}
+}
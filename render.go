@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxNumericPrecision is the largest precision of a numeric column, a larger one means the column has no type modifier.
+const maxNumericPrecision = 1000
+
+// column is a result set column.
+type column struct {
+	name   string
+	label  string // header text: the name, optionally followed by the type
+	dbType string // DatabaseTypeName, for example NUMERIC, or _INT4 for an int4 array
+}
+
+// cell is a rendered result value.
+type cell struct {
+	text string // NULL is the NULL marker
+	null bool
+	json []byte // the value encoded as JSON, typed by the column type
+}
+
+// renderer renders result values by their column type.
+type renderer struct {
+	nullDisplay string
+	location    *time.Location // time zone of timestamptz values, nil keeps the session time zone
+	showTypes   bool
+}
+
+// columns returns the columns of a result set.
+func (r renderer) columns(types []*sql.ColumnType) []column {
+	columns := make([]column, len(types))
+	for i, t := range types {
+		columns[i] = column{
+			name:   t.Name(),
+			label:  t.Name(),
+			dbType: t.DatabaseTypeName(),
+		}
+		if r.showTypes {
+			if typeName := columnTypeName(t); typeName != "" {
+				columns[i].label = fmt.Sprintf("%s (%s)", t.Name(), typeName)
+			}
+		}
+	}
+	return columns
+}
+
+// columnTypeName formats the type of a column the way PostgreSQL does, for example numeric(10,2),
+// varchar(255) or int4[], followed by "not null" if the driver reports the column is not nullable.
+func columnTypeName(t *sql.ColumnType) string {
+	name := strings.ToLower(t.DatabaseTypeName())
+	if name == "" {
+		return ""
+	}
+	array := strings.HasPrefix(name, "_")
+	name = strings.TrimPrefix(name, "_")
+
+	if precision, scale, ok := t.DecimalSize(); ok && precision > 0 && precision <= maxNumericPrecision {
+		name += fmt.Sprintf("(%d,%d)", precision, scale)
+	} else if length, ok := t.Length(); ok && length > 0 && length < math.MaxInt32 {
+		name += fmt.Sprintf("(%d)", length)
+	}
+	if array {
+		name += "[]"
+	}
+	if nullable, ok := t.Nullable(); ok && !nullable {
+		name += " not null"
+	}
+	return name
+}
+
+// render renders a value scanned from a column.
+func (r renderer) render(c column, v interface{}) cell {
+	switch value := v.(type) {
+	case nil:
+		return cell{text: r.nullDisplay, null: true, json: []byte("null")}
+	case bool:
+		text := strconv.FormatBool(value)
+		return cell{text: text, json: []byte(text)}
+	case int64:
+		text := strconv.FormatInt(value, 10)
+		return cell{text: text, json: []byte(text)}
+	case float64:
+		bits := 64
+		if c.dbType == "FLOAT4" {
+			bits = 32
+		}
+		text := strconv.FormatFloat(value, 'g', -1, bits)
+		if math.IsInf(value, 0) || math.IsNaN(value) {
+			return textCell(text)
+		}
+		return cell{text: text, json: []byte(text)}
+	case time.Time:
+		return textCell(r.formatTime(c, value))
+	case []byte:
+		return r.renderBytes(c, value)
+	case string:
+		return textCell(value)
+	default:
+		return textCell(fmt.Sprint(value))
+	}
+}
+
+func textCell(text string) cell {
+	encoded, err := marshalJSON(text)
+	if err != nil {
+		encoded = []byte("null")
+	}
+	return cell{text: text, json: encoded}
+}
+
+// renderBytes renders a value the driver returns as bytes: bytea is hex encoded, json is pretty-printed,
+// numeric stays a JSON number, except NaN and infinity, which JSON has no number for. Other types are returned as their text representation.
+func (r renderer) renderBytes(c column, value []byte) cell {
+	switch c.dbType {
+	case "BYTEA":
+		return textCell(`\x` + hex.EncodeToString(value))
+	case "JSON", "JSONB":
+		var pretty bytes.Buffer
+		if err := json.Indent(&pretty, value, "", "  "); err != nil {
+			return textCell(string(value))
+		}
+		var compact bytes.Buffer
+		if err := json.Compact(&compact, value); err != nil {
+			return textCell(string(value))
+		}
+		return cell{text: pretty.String(), json: compact.Bytes()}
+	case "NUMERIC":
+		text := string(value)
+		f, err := strconv.ParseFloat(text, 64)
+		if err != nil || math.IsInf(f, 0) || math.IsNaN(f) {
+			return textCell(text)
+		}
+		return cell{text: text, json: value}
+	default:
+		return textCell(string(value))
+	}
+}
+
+// formatTime formats date and time values the way PostgreSQL prints them in ISO style.
+// timestamptz values are converted to the display time zone, if one is set.
+func (r renderer) formatTime(c column, t time.Time) string {
+	switch c.dbType {
+	case "DATE":
+		return t.Format("2006-01-02")
+	case "TIME":
+		return t.Format("15:04:05.999999")
+	case "TIMETZ":
+		return t.Format("15:04:05.999999-07:00")
+	case "TIMESTAMP":
+		return t.Format("2006-01-02 15:04:05.999999")
+	default:
+		if r.location != nil {
+			t = t.In(r.location)
+		}
+		return t.Format("2006-01-02 15:04:05.999999-07:00")
+	}
+}
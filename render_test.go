@@ -0,0 +1,44 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestRenderNumeric(t *testing.T) {
+	numeric := column{name: "n", dbType: "NUMERIC"}
+	tests := []struct {
+		value string
+		json  string
+	}{
+		{"1.50", "1.50"},
+		{"-12345678901234567890.1", "-12345678901234567890.1"},
+		{"NaN", `"NaN"`},
+		{"Infinity", `"Infinity"`},
+		{"-Infinity", `"-Infinity"`},
+		{"1e400", `"1e400"`},
+	}
+	for _, tt := range tests {
+		got := renderer{}.renderBytes(numeric, []byte(tt.value))
+		if got.text != tt.value || string(got.json) != tt.json {
+			t.Errorf("renderBytes(%q) = %q, %s, want %q, %s", tt.value, got.text, got.json, tt.value, tt.json)
+		}
+	}
+}
+
+func TestRenderFloat(t *testing.T) {
+	tests := []struct {
+		value float64
+		json  string
+	}{
+		{1.5, "1.5"},
+		{math.Inf(1), `"+Inf"`},
+		{math.Inf(-1), `"-Inf"`},
+		{math.NaN(), `"NaN"`},
+	}
+	for _, tt := range tests {
+		if got := (renderer{}).render(column{dbType: "FLOAT8"}, tt.value); string(got.json) != tt.json {
+			t.Errorf("render(%v) json = %s, want %s", tt.value, got.json, tt.json)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const maxConnectBackoff = 30 * time.Second
+
+// retryPolicy configures how connecting to a database that is not ready yet is retried.
+type retryPolicy struct {
+	retries int
+	backoff time.Duration // delay before the first retry, doubled after each retry
+}
+
+// delay returns the wait before the given retry (1 based), with exponential backoff.
+func (p retryPolicy) delay(retry int) time.Duration {
+	d := p.backoff
+	for i := 1; i < retry && d < maxConnectBackoff; i++ {
+		d *= 2
+	}
+	if d > maxConnectBackoff {
+		d = maxConnectBackoff
+	}
+	return d
+}
+
+// isRetryableConnectError reports whether connecting may succeed later, for example when the server is still
+// starting up (connection refused, 57P03 cannot_connect_now). Authentication and configuration errors
+// (like 28P01 invalid_password) fail immediately.
+func isRetryableConnectError(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code {
+		case "57P03", // cannot_connect_now
+			"53300", // too_many_connections
+			"08000", // connection_exception
+			"08001", // sqlclient_unable_to_establish_sqlconnection
+			"08006": // connection_failure
+			return true
+		default:
+			return false
+		}
+	}
+
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
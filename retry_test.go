@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+	tests := []struct {
+		backoff time.Duration
+		retry   int
+		want    time.Duration
+	}{
+		{time.Second, 1, time.Second},
+		{time.Second, 2, 2 * time.Second},
+		{time.Second, 3, 4 * time.Second},
+		{time.Second, 5, 16 * time.Second},
+		{time.Second, 6, maxConnectBackoff},
+		{time.Second, 100, maxConnectBackoff},
+		{3 * time.Second, 2, 6 * time.Second},
+		{time.Minute, 1, maxConnectBackoff},
+	}
+	for _, tt := range tests {
+		if got := (retryPolicy{retries: 5, backoff: tt.backoff}).delay(tt.retry); got != tt.want {
+			t.Errorf("delay(%d) with backoff %s = %s, want %s", tt.retry, tt.backoff, got, tt.want)
+		}
+	}
+}
+
+func TestIsRetryableConnectError(t *testing.T) {
+	pqErr := func(code pq.ErrorCode) error {
+		return &pq.Error{Code: code}
+	}
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: &os.SyscallError{Syscall: "connect", Err: syscall.ECONNREFUSED}}
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"connection refused", refused, true},
+		{"wrapped connection refused", fmt.Errorf("failed to connect, error: %w", refused), true},
+		{"dns", &net.DNSError{Err: "no such host", Name: "db", IsTemporary: true}, true},
+		{"eof", io.EOF, true},
+		{"unexpected eof", io.ErrUnexpectedEOF, true},
+		{"cannot connect now", pqErr("57P03"), true},
+		{"wrapped cannot connect now", fmt.Errorf("failed to ping, error: %w", pqErr("57P03")), true},
+		{"too many connections", pqErr("53300"), true},
+		{"connection failure", pqErr("08006"), true},
+		{"invalid password", pqErr("28P01"), false},
+		{"wrapped invalid password", fmt.Errorf("failed to ping, error: %w", pqErr("28P01")), false},
+		{"invalid catalog name", pqErr("3D000"), false},
+		{"other error", errors.New("pq: unknown sslmode"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isRetryableConnectError(tt.err); got != tt.want {
+				t.Errorf("isRetryableConnectError(%v) = %t, want %t", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateConnectBackoff(t *testing.T) {
+	tests := []struct {
+		retries, backoff int
+		wantErr          bool
+	}{
+		{retries: 5, backoff: 1},
+		{retries: 0, backoff: 0},
+		{retries: 5, backoff: 0, wantErr: true},
+		{retries: 5, backoff: -1, wantErr: true},
+	}
+	for _, tt := range tests {
+		cfg := config{DatabaseURL: "postgres://ci@localhost/app", ConnectRetries: tt.retries, ConnectBackoff: tt.backoff}
+		if err := cfg.validateConnection(); (err != nil) != tt.wantErr {
+			t.Errorf("validateConnection() with connect_retries %d and connect_backoff %d error = %v, want error: %t", tt.retries, tt.backoff, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// splitDownScripts separates the down scripts, which only run when rolling back, from the scripts run forward.
+func splitDownScripts(scripts []script) (forward, down []script, err error) {
+	for _, s := range scripts {
+		if scriptDirection(s.name) != directionDown {
+			forward = append(forward, s)
+			continue
+		}
+		if s.version == "" {
+			return nil, nil, fmt.Errorf("down script without a version: %s", s.name)
+		}
+		for _, other := range down {
+			if other.database == s.database && compareVersions(other.version, s.version) == 0 {
+				return nil, nil, fmt.Errorf("duplicate down scripts: %s and %s (version %s)", other.name, s.name, s.version)
+			}
+		}
+		down = append(down, s)
+	}
+	return forward, down, nil
+}
+
+// rollbackScripts returns the down scripts rolling back the applied scripts of a target database
+// with a version above targetVersion, in reverse version order. Each applied script needs a down
+// script with the same version.
+func rollbackScripts(t *target, down []script, targetVersion string) ([]script, error) {
+	var applied []appliedScript
+	for _, entry := range t.applied {
+		if entry.success && entry.version != "" && compareVersions(entry.version, targetVersion) > 0 {
+			applied = append(applied, entry)
+		}
+	}
+	sort.Slice(applied, func(i, j int) bool {
+		return compareVersions(applied[i].version, applied[j].version) > 0
+	})
+
+	var rollbacks []script
+	var missing []string
+	for _, entry := range applied {
+		found := false
+		for _, s := range down {
+			if s.database == t.database && compareVersions(s.version, entry.version) == 0 {
+				s.rollbackOf = entry.name
+				rollbacks = append(rollbacks, s)
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, path.Base(entry.name))
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("cannot roll back database %s to version %s, no down script for: %s", t.database, targetVersion, strings.Join(missing, ", "))
+	}
+	return rollbacks, nil
+}
+
+// aboveTarget reports whether a forward script is skipped because its version is above target_version.
+func aboveTarget(s script, targetVersion string) bool {
+	return targetVersion != "" && !s.repeatable && compareVersions(s.version, targetVersion) > 0
+}
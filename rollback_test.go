@@ -0,0 +1,131 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitDownScripts(t *testing.T) {
+	scripts := []script{
+		{name: "V1__a.sql", version: "1", database: "app"},
+		{name: "V2__b.up.sql", version: "2", database: "app"},
+		{name: "V2__b.down.sql", version: "2", database: "app"},
+		{name: "V2__b.DOWN.SQL", version: "2", database: "audit"},
+		{name: "R__views.sql", database: "app"},
+	}
+	forward, down, err := splitDownScripts(scripts)
+	if err != nil {
+		t.Fatalf("splitDownScripts() error: %s", err)
+	}
+	var forwardNames, downNames []string
+	for _, s := range forward {
+		forwardNames = append(forwardNames, s.name)
+	}
+	for _, s := range down {
+		downNames = append(downNames, s.name)
+	}
+	if want := []string{"V1__a.sql", "V2__b.up.sql", "R__views.sql"}; !reflect.DeepEqual(forwardNames, want) {
+		t.Errorf("splitDownScripts() forward = %v, want %v", forwardNames, want)
+	}
+	if want := []string{"V2__b.down.sql", "V2__b.DOWN.SQL"}; !reflect.DeepEqual(downNames, want) {
+		t.Errorf("splitDownScripts() down = %v, want %v", downNames, want)
+	}
+
+	tests := []struct {
+		name    string
+		scripts []script
+		wantErr string
+	}{
+		{
+			name:    "without a version",
+			scripts: []script{{name: "undo.down.sql", database: "app"}},
+			wantErr: "down script without a version: undo.down.sql",
+		},
+		{
+			name: "duplicate",
+			scripts: []script{
+				{name: "a/V2__b.down.sql", version: "2", database: "app"},
+				{name: "a/V2__b.down.sql", version: "2", database: "audit"},
+				{name: "b/V2.0__c.down.sql", version: "2.0", database: "app"},
+			},
+			wantErr: "duplicate down scripts: a/V2__b.down.sql and b/V2.0__c.down.sql (version 2.0)",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := splitDownScripts(tt.scripts); err == nil || err.Error() != tt.wantErr {
+				t.Errorf("splitDownScripts() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRollbackScripts(t *testing.T) {
+	tgt := &target{
+		database: "app",
+		applied: map[string]appliedScript{
+			"V1__a.sql":      {name: "V1__a.sql", version: "1", success: true},
+			"V2__b.up.sql":   {name: "V2__b.up.sql", version: "2", success: true},
+			"V10__c.sql":     {name: "V10__c.sql", version: "10", success: true},
+			"V3__failed.sql": {name: "V3__failed.sql", version: "3", success: false},
+			"R__views.sql":   {name: "R__views.sql", success: true},
+		},
+	}
+	down := []script{
+		{name: "V1__a.down.sql", version: "1", database: "app"},
+		{name: "V2__b.down.sql", version: "2", database: "app"},
+		{name: "V10__c.down.sql", version: "10", database: "audit"},
+		{name: "sub/V10__c.down.sql", version: "10", database: "app"},
+	}
+
+	tests := []struct {
+		targetVersion string
+		want          []string // down script: rolled back script
+		wantErr       string
+	}{
+		{targetVersion: "10"},
+		{targetVersion: "2", want: []string{"sub/V10__c.down.sql: V10__c.sql"}},
+		{targetVersion: "1.5", want: []string{"sub/V10__c.down.sql: V10__c.sql", "V2__b.down.sql: V2__b.up.sql"}},
+		{targetVersion: "0", want: []string{"sub/V10__c.down.sql: V10__c.sql", "V2__b.down.sql: V2__b.up.sql", "V1__a.down.sql: V1__a.sql"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.targetVersion, func(t *testing.T) {
+			rollbacks, err := rollbackScripts(tgt, down, tt.targetVersion)
+			if err != nil {
+				t.Fatalf("rollbackScripts() error: %s", err)
+			}
+			var got []string
+			for _, s := range rollbacks {
+				got = append(got, s.name+": "+s.rollbackOf)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("rollbackScripts() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	_, err := rollbackScripts(tgt, down[2:], "0")
+	want := "cannot roll back database app to version 0, no down script for: V2__b.up.sql, V1__a.sql"
+	if err == nil || err.Error() != want {
+		t.Errorf("rollbackScripts() error = %v, want %q", err, want)
+	}
+}
+
+func TestAboveTarget(t *testing.T) {
+	tests := []struct {
+		s             script
+		targetVersion string
+		want          bool
+	}{
+		{script{version: "3"}, "", false},
+		{script{version: "3"}, "2", true},
+		{script{version: "2.0"}, "2", false},
+		{script{version: "1.10"}, "1.9", true},
+		{script{repeatable: true}, "2", false},
+	}
+	for _, tt := range tests {
+		if got := aboveTarget(tt.s, tt.targetVersion); got != tt.want {
+			t.Errorf("aboveTarget(%+v, %q) = %t, want %t", tt.s, tt.targetVersion, got, tt.want)
+		}
+	}
+}
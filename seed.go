@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// seedOrderPrefix matches the optional ordering prefix of a seed file name, for example 001_ in 001_users.csv.
+var seedOrderPrefix = regexp.MustCompile(`^[0-9]+_`)
+
+// seedFile is a CSV or TSV file loaded into the table it is named after.
+type seedFile struct {
+	name string
+	copy copyCommand
+}
+
+// discoverSeeds finds the *.csv and *.tsv files of the seed dir, in path order. The first line of each file
+// lists the columns (used as is, not folded to lower case). The table is the file name without the extension
+// and the ordering prefix, optionally schema qualified: 001_app.users.csv is loaded into app.users.
+func discoverSeeds(dir string) ([]seedFile, error) {
+	names, err := discoverScripts(dir, []string{"**/*.csv", "**/*.tsv"}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var seeds []seedFile
+	for _, name := range names {
+		c := copyCommand{
+			file:      filepath.Join(dir, filepath.FromSlash(name)),
+			csv:       strings.EqualFold(path.Ext(name), ".csv"),
+			header:    true,
+			delimiter: '\t',
+			quote:     '"',
+			escape:    '"',
+		}
+		if c.csv {
+			c.delimiter = ','
+		}
+
+		table := seedOrderPrefix.ReplaceAllString(strings.TrimSuffix(path.Base(name), path.Ext(name)), "")
+		if idx := strings.Index(table, "."); idx != -1 {
+			c.schema, table = table[:idx], table[idx+1:]
+		}
+		if table == "" || strings.Contains(table, ".") {
+			return nil, fmt.Errorf("invalid seed file name: %s, expected [schema.]table.csv or [schema.]table.tsv", name)
+		}
+		c.table = table
+
+		if c.columns, err = seedColumns(c); err != nil {
+			return nil, fmt.Errorf("invalid seed file: %s, error: %s", name, err)
+		}
+		seeds = append(seeds, seedFile{name: name, copy: c})
+	}
+	return seeds, nil
+}
+
+// seedColumns reads the column names from the first line of a seed file.
+func seedColumns(c copyCommand) ([]string, error) {
+	file, err := os.Open(c.file)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			log.Warnf("failed to close file: %s, error: %s", c.file, err)
+		}
+	}()
+
+	c.header = false
+	header, err := newCopyReader(c, file).read()
+	if err == io.EOF {
+		return nil, fmt.Errorf("missing header line")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	columns := make([]string, len(header))
+	for i, column := range header {
+		name, ok := column.(string)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("empty column name in header line")
+		}
+		columns[i] = name
+	}
+	return columns, nil
+}
+
+// table returns the (schema qualified) table a seed file is loaded into.
+func (s seedFile) table() string {
+	if s.copy.schema != "" {
+		return s.copy.schema + "." + s.copy.table
+	}
+	return s.copy.table
+}
+
+func printSeedPlan(seeds []seedFile) {
+	if len(seeds) == 0 {
+		return
+	}
+	log.Printf("Seed files, loaded after the scripts:")
+	for i, s := range seeds {
+		log.Printf("%d. %s into %s (%s)", i+1, s.name, s.table(), strings.Join(s.copy.columns, ", "))
+	}
+}
+
+// seed loads the seed files into the default database and reports whether all of them were loaded.
+// In transaction mode all they are loaded in the batch transaction, otherwise each file in its own transaction.
+func (e *executor) seed(seeds []seedFile) bool {
+	var q queryer = e.targets[e.cfg.databaseName()].db
+	if e.batch != nil {
+		q = e.batch
+	}
+
+	var total int64
+	startTime := time.Now()
+	for _, s := range seeds {
+		fileStartTime := time.Now()
+		rows, err := copyFrom(q, s.copy)
+		if err != nil {
+			log.Errorf("Failed to load seed file: %s, error: %s", s.name, err)
+			if e.batch != nil {
+				rollback(e.batch)
+				e.batch = nil
+				log.Warnf("Rolled back all scripts of the batch")
+			}
+			return false
+		}
+		log.Printf("Loaded %d rows into %s from %s, duration: %s", rows, s.table(), s.name, time.Since(fileStartTime))
+		total += rows
+	}
+	log.Donef("Loaded %d rows from %d seed files, duration: %s", total, len(seeds), time.Since(startTime))
+	return true
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDiscoverSeeds(t *testing.T) {
+	dir, err := ioutil.TempDir("", "seed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	files := map[string]string{
+		"001_users.csv":         "id,\"Name\"\n1,a\n",
+		"002_app.orders.tsv":    "id\tuser_id\n",
+		"fixtures/003_TAGS.CSV": "id\n",
+		"notes.txt":             "not a seed\n",
+	}
+	for name, content := range files {
+		pth := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(pth), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(pth, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	seeds, err := discoverSeeds(dir)
+	if err != nil {
+		t.Fatalf("discoverSeeds() error: %s", err)
+	}
+
+	type seed struct {
+		name    string
+		table   string
+		columns []string
+		csv     bool
+	}
+	want := []seed{
+		{"001_users.csv", "users", []string{"id", "Name"}, true},
+		{"002_app.orders.tsv", "app.orders", []string{"id", "user_id"}, false},
+		{"fixtures/003_TAGS.CSV", "TAGS", []string{"id"}, true},
+	}
+	var got []seed
+	for _, s := range seeds {
+		got = append(got, seed{s.name, s.table(), s.copy.columns, s.copy.csv})
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("discoverSeeds() = %+v, want %+v", got, want)
+	}
+}
+
+func TestDiscoverSeedsInvalid(t *testing.T) {
+	for name, content := range map[string]string{
+		"a.b.c.csv": "id\n",
+		"empty.csv": "",
+		"blank.csv": "id,\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "seed")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				if err := os.RemoveAll(dir); err != nil {
+					t.Error(err)
+				}
+			}()
+			if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := discoverSeeds(dir); err == nil {
+				t.Errorf("discoverSeeds() expected error")
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// sessionSetting is a run-time parameter set on every connection before scripts run.
+type sessionSetting struct {
+	name  string
+	value string
+}
+
+// sessionConnector applies the session settings to every new connection of the pool,
+// since database/sql may run statements on any of its connections.
+type sessionConnector struct {
+	driver.Connector
+	settings []sessionSetting
+}
+
+// Connect implements driver.Connector.
+func (c sessionConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil || len(c.settings) == 0 {
+		return conn, err
+	}
+
+	execer, ok := conn.(driver.ExecerContext)
+	if !ok {
+		closeDriverConn(conn)
+		return nil, fmt.Errorf("driver connection does not support executing statements")
+	}
+	for _, setting := range c.settings {
+		// set_config with is_local false is the same as SET, the role setting is the same as SET ROLE.
+		args := []driver.NamedValue{
+			{Ordinal: 1, Value: setting.name},
+			{Ordinal: 2, Value: setting.value},
+		}
+		if _, err := execer.ExecContext(ctx, "SELECT set_config($1, $2, false)", args); err != nil {
+			closeDriverConn(conn)
+			return nil, fmt.Errorf("failed to set %s to %s, error: %s", setting.name, setting.value, err)
+		}
+	}
+	return conn, nil
+}
+
+func closeDriverConn(conn driver.Conn) {
+	if err := conn.Close(); err != nil {
+		log.Warnf("failed to close connection, error: %s", err)
+	}
+}
+
+// sessionSettings returns the settings of the non-empty session inputs.
+func sessionSettings(cfg config) []sessionSetting {
+	var settings []sessionSetting
+	for _, s := range []sessionSetting{
+		{"statement_timeout", cfg.StatementTimeout},
+		{"lock_timeout", cfg.LockTimeout},
+		{"idle_in_transaction_session_timeout", cfg.IdleInTransactionSessionTimeout},
+		{"search_path", cfg.SearchPath},
+		{"role", cfg.Role},
+	} {
+		if s.value != "" {
+			settings = append(settings, s)
+		}
+	}
+	return settings
+}
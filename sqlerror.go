@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/lib/pq"
+)
+
+// scriptError is a failed statement of a script. It maps the position reported by
+// the server back to the script file and formats it like a compiler error:
+//
+//	schema.sql:42:7: ERROR 42P01 relation "x" does not exist
+type scriptError struct {
+	file    string
+	content string
+	sources []sourceRegion
+	stmt    statement
+	text    string            // text sent to the server, empty if it is the statement text
+	vars    map[string]string // \gset variables substituted in text
+	err     error
+}
+
+func (e scriptError) Error() string {
+	var pqErr *pq.Error
+	file := e.file
+	if e.stmt.file != "" {
+		file = e.stmt.file
+	}
+	if !errors.As(e.err, &pqErr) {
+		return fmt.Sprintf("%s:%d: statement %d failed: %s", file, e.stmt.startLine, e.stmt.index, e.err)
+	}
+
+	severity := pqErr.Severity
+	if severity == "" {
+		severity = "ERROR"
+	}
+
+	var b strings.Builder
+	text := e.stmt.text
+	if e.text != "" {
+		text = e.text
+	}
+	offset, ok := statementOffset(text, pqErr.Position)
+	if ok {
+		offset = e.stmt.unsubstitutedOffset(offset, e.vars)
+		line, column := lineAndColumn(e.content, e.stmt.offset+offset)
+		if len(e.sources) > 0 {
+			file, line = sourceLine(e.sources, line)
+		}
+		fmt.Fprintf(&b, "%s:%d:%d: %s %s %s\n", file, line, column, severity, pqErr.Code, pqErr.Message)
+		b.WriteString(excerpt(e.content, e.stmt.offset+offset, line))
+	} else {
+		fmt.Fprintf(&b, "%s:%d: %s %s %s\n", file, e.stmt.startLine, severity, pqErr.Code, pqErr.Message)
+	}
+
+	writeField(&b, "DETAIL", pqErr.Detail)
+	writeField(&b, "HINT", pqErr.Hint)
+	if pqErr.InternalQuery != "" {
+		writeField(&b, "QUERY", pqErr.InternalQuery)
+		if offset, ok := statementOffset(pqErr.InternalQuery, pqErr.InternalPosition); ok {
+			b.WriteString(excerpt(pqErr.InternalQuery, offset, lineAt(pqErr.InternalQuery, offset)))
+		}
+	}
+	writeField(&b, "WHERE", pqErr.Where)
+	writeField(&b, "SCHEMA", pqErr.Schema)
+	writeField(&b, "TABLE", pqErr.Table)
+	writeField(&b, "COLUMN", pqErr.Column)
+	writeField(&b, "DATATYPE", pqErr.DataTypeName)
+	writeField(&b, "CONSTRAINT", pqErr.Constraint)
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+func writeField(b *strings.Builder, name, value string) {
+	if value != "" {
+		fmt.Fprintf(b, "%s: %s\n", name, value)
+	}
+}
+
+// statementOffset converts a 1 based character position reported by the server to a byte offset in text.
+func statementOffset(text, position string) (int, bool) {
+	if position == "" {
+		return 0, false
+	}
+	pos, err := strconv.Atoi(position)
+	if err != nil || pos < 1 {
+		return 0, false
+	}
+
+	offset := 0
+	for i := 1; i < pos; i++ {
+		if offset >= len(text) {
+			return 0, false
+		}
+		_, size := utf8.DecodeRuneInString(text[offset:])
+		offset += size
+	}
+	return offset, true
+}
+
+// lineAndColumn returns the 1 based line and character column of a byte offset in content.
+func lineAndColumn(content string, offset int) (int, int) {
+	lineStart := strings.LastIndexByte(content[:offset], '\n') + 1
+	return lineAt(content, offset), utf8.RuneCountInString(content[lineStart:offset]) + 1
+}
+
+// excerpt returns the line containing the byte offset, with a caret marking the offset.
+// The line number shown is the line of the source file.
+func excerpt(content string, offset, line int) string {
+	lineStart := strings.LastIndexByte(content[:offset], '\n') + 1
+	lineEnd := strings.IndexByte(content[offset:], '\n')
+	if lineEnd == -1 {
+		lineEnd = len(content)
+	} else {
+		lineEnd += offset
+	}
+
+	// Keep tabs in the padding so the caret lines up with the source line.
+	var padding strings.Builder
+	for _, r := range content[lineStart:offset] {
+		if r == '\t' {
+			padding.WriteRune('\t')
+		} else {
+			padding.WriteRune(' ')
+		}
+	}
+	gutter := strconv.Itoa(line)
+	return fmt.Sprintf("%s | %s\n%s | %s^\n", gutter, strings.TrimRight(content[lineStart:lineEnd], "\r"), strings.Repeat(" ", len(gutter)), padding.String())
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/lib/pq"
+)
+
+func TestScriptErrorPosition(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		vars    map[string]string
+		near    string // text the server reports the error at, in the sent text
+		want    string
+	}{
+		{
+			name:    "no variables",
+			content: "SELECT 1;\nSELECT nope FROM t;\n",
+			near:    "nope",
+			want:    "test.sql:2:8: ERROR 42703 column does not exist",
+		},
+		{
+			name:    "after a longer gset value",
+			content: "SELECT 1 AS a \\gset\nSELECT :'a', nope FROM t;\n",
+			vars:    map[string]string{"a": "a much longer value"},
+			near:    "nope",
+			want:    "test.sql:2:14: ERROR 42703 column does not exist",
+		},
+		{
+			name:    "after a shorter gset value",
+			content: "SELECT 1 AS name \\gset\nSELECT :name + :name, nope FROM t;\n",
+			vars:    map[string]string{"name": "1"},
+			near:    "nope",
+			want:    "test.sql:2:23: ERROR 42703 column does not exist",
+		},
+		{
+			name:    "inside a gset value",
+			content: "SELECT 1 AS a \\gset\nSELECT 1, :a FROM t;\n",
+			vars:    map[string]string{"a": "1 + nope"},
+			near:    "nope",
+			want:    "test.sql:2:11: ERROR 42703 column does not exist",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pre, err := preprocessScript("test.sql", "test.sql", tt.content, nil)
+			if err != nil {
+				t.Fatalf("preprocessScript() error: %s", err)
+			}
+			statements, _, err := pre.split()
+			if err != nil {
+				t.Fatalf("split() error: %s", err)
+			}
+			stmt := statements[len(statements)-1]
+			text, err := stmt.substitute(tt.vars)
+			if err != nil {
+				t.Fatalf("substitute() error: %s", err)
+			}
+
+			position := utf8.RuneCountInString(text[:strings.Index(text, tt.near)]) + 1
+			e := scriptError{
+				file:    "test.sql",
+				content: pre.content,
+				sources: pre.sources,
+				stmt:    stmt,
+				text:    text,
+				vars:    tt.vars,
+				err:     &pq.Error{Severity: "ERROR", Code: "42703", Message: "column does not exist", Position: strconv.Itoa(position)},
+			}
+			if got := strings.SplitN(e.Error(), "\n", 2)[0]; got != tt.want {
+				t.Errorf("Error() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
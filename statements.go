@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/bitrise-io/go-utils/log"
+	pg_query "github.com/lfittl/pg_query_go"
+	nodes "github.com/lfittl/pg_query_go/nodes"
+)
+
+// statement is a single SQL statement of a script, as located by the pg_query parse tree.
+type statement struct {
+	index     int
+	text      string
+	offset    int // byte offset of text in the script content
+	startLine int
+	endLine   int
+	node      nodes.Node
+	file      string        // file the statement was included from with \i or \ir, empty for the script itself
+	refs      []variableRef // references to variables set by \gset
+
+	annotations []annotation
+}
+
+// splitStatements parses a script and splits it into its top level statements (RawStmt nodes).
+func splitStatements(content string) ([]statement, error) {
+	tree, err := pg_query.Parse(content)
+	if err != nil {
+		return nil, err
+	}
+
+	var statements []statement
+	for i, node := range tree.Statements {
+		raw, ok := node.(nodes.RawStmt)
+		if !ok {
+			return nil, fmt.Errorf("unexpected parse tree node: %T", node)
+		}
+
+		start := raw.StmtLocation
+		if start < 0 {
+			start = 0
+		}
+		end := len(content)
+		if raw.StmtLen > 0 {
+			end = start + raw.StmtLen
+		}
+		if end > len(content) {
+			return nil, fmt.Errorf("statement %d is out of the script bounds", i+1)
+		}
+
+		text := content[start:end]
+		trimmed := strings.TrimLeftFunc(text, unicode.IsSpace)
+		offset := start + len(text) - len(trimmed)
+		text = strings.TrimRightFunc(trimmed, unicode.IsSpace)
+		codeStart := offset + skipComments(text)
+
+		statements = append(statements, statement{
+			index:     i + 1,
+			text:      text,
+			offset:    offset,
+			startLine: lineAt(content, codeStart),
+			endLine:   lineAt(content, offset+len(text)),
+			node:      raw.Stmt,
+
+			annotations: parseAnnotations(text),
+		})
+	}
+	return statements, nil
+}
+
+// skipComments returns the length of the leading whitespace and comments of a statement.
+func skipComments(text string) int {
+	i := 0
+	for i < len(text) {
+		switch {
+		case unicode.IsSpace(rune(text[i])):
+			i++
+		case strings.HasPrefix(text[i:], "--"):
+			end := strings.IndexByte(text[i:], '\n')
+			if end == -1 {
+				return len(text)
+			}
+			i += end + 1
+		case strings.HasPrefix(text[i:], "/*"):
+			end := strings.Index(text[i+2:], "*/")
+			if end == -1 {
+				return len(text)
+			}
+			i += end + 4
+		default:
+			return i
+		}
+	}
+	return i
+}
+
+// lineAt returns the 1 based line number of a byte offset in content.
+func lineAt(content string, offset int) int {
+	if offset > len(content) {
+		offset = len(content)
+	}
+	return strings.Count(content[:offset], "\n") + 1
+}
+
+// statementType returns the parse tree node name of a statement, for example SelectStmt.
+func statementType(node nodes.Node) string {
+	return reflect.TypeOf(node).Name()
+}
+
+// returnsRows reports whether a statement produces a result set.
+func returnsRows(node nodes.Node) bool {
+	switch n := node.(type) {
+	case nodes.SelectStmt, nodes.ExplainStmt, nodes.VariableShowStmt, nodes.FetchStmt, nodes.ExecuteStmt:
+		return true
+	case nodes.InsertStmt:
+		return len(n.ReturningList.Items) > 0
+	case nodes.UpdateStmt:
+		return len(n.ReturningList.Items) > 0
+	case nodes.DeleteStmt:
+		return len(n.ReturningList.Items) > 0
+	default:
+		return false
+	}
+}
+
+func (s statement) lines() string {
+	lines := fmt.Sprintf("lines %d-%d", s.startLine, s.endLine)
+	if s.startLine == s.endLine {
+		lines = fmt.Sprintf("line %d", s.startLine)
+	}
+	if s.file != "" {
+		lines += " of " + s.file
+	}
+	return lines
+}
+
+// runScript runs the statements of a script one by one, stopping at the first failing statement.
+// Meta-commands run before the statement they precede, \gset runs its statement and sets variables.
+func runScript(db queryer, script script, output *resultOutput) error {
+	before := map[int][]metaCommand{}
+	gset := map[int]metaCommand{}
+	for _, command := range script.commands {
+		if command.name == commandGset {
+			gset[command.statement] = command
+		} else {
+			before[command.statement] = append(before[command.statement], command)
+		}
+	}
+
+	vars := map[string]string{}
+	for _, stmt := range script.statements {
+		for _, command := range before[stmt.index] {
+			if err := runCommand(db, command, vars); err != nil {
+				return err
+			}
+		}
+
+		log.Printf("Statement %d/%d (%s): %s", stmt.index, len(script.statements), stmt.lines(), statementType(stmt.node))
+
+		scriptErr := scriptError{
+			file:    script.name,
+			content: script.content,
+			sources: script.sources,
+			stmt:    stmt,
+		}
+		text, err := stmt.substitute(vars)
+		if err != nil {
+			scriptErr.err = err
+			return scriptErr
+		}
+		scriptErr.text = text
+		scriptErr.vars = vars
+
+		startTime := time.Now()
+		if command, ok := gset[stmt.index]; ok {
+			if err := runGset(db, text, command.args, vars); err != nil {
+				scriptErr.err = err
+				return scriptErr
+			}
+			log.Printf("Variables set, duration: %s", time.Since(startTime))
+			continue
+		}
+
+		substituted := stmt
+		substituted.text = text
+		if code := expectedError(stmt.annotations); code != "" {
+			if err := runExpectingError(db, substituted, output, code); err != nil {
+				scriptErr.err = err
+				return scriptErr
+			}
+			log.Printf("Failed with the expected error %s, duration: %s", code, time.Since(startTime))
+			continue
+		}
+
+		var capture *resultCapture
+		if len(stmt.annotations) > 0 {
+			capture = newResultCapture(stmt.annotations)
+			output.capture = capture
+		}
+		rows, err := runSQLStatement(db, substituted, output)
+		output.capture = nil
+		if err != nil {
+			scriptErr.err = err
+			return scriptErr
+		}
+		if capture != nil {
+			if err := checkExpectations(stmt.annotations, rows, capture); err != nil {
+				scriptErr.err = err
+				return scriptErr
+			}
+			if err := output.outputs.export(stmt.annotations, capture); err != nil {
+				scriptErr.err = err
+				return scriptErr
+			}
+		}
+
+		if returnsRows(stmt.node) {
+			log.Printf("Rows returned: %d, duration: %s", rows, time.Since(startTime))
+		} else {
+			log.Printf("Rows affected: %d, duration: %s", rows, time.Since(startTime))
+		}
+	}
+
+	for _, command := range before[len(script.statements)+1] {
+		if err := runCommand(db, command, vars); err != nil {
+			return err
+		}
+	}
+	return nil
+}
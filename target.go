@@ -0,0 +1,171 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// target is a database the scripts run against, with its migration history.
+type target struct {
+	database      string
+	db            *sql.DB
+	serverVersion int
+	history       migrationHistory
+	applied       map[string]appliedScript
+	lock          *advisoryLock
+}
+
+// openTarget connects to a database and loads its migration history, failing if any of its
+// applied scripts changed since. In dry run mode nothing is written to the database.
+func openTarget(cfg config, tls *tlsFiles, database string, scripts []script) (*target, error) {
+	db, err := connectToDB(dbInfo{
+		url:            string(cfg.DatabaseURL),
+		host:           cfg.DbHost,
+		port:           cfg.DbPort,
+		username:       cfg.DbUsername,
+		password:       string(cfg.DbPassword),
+		sslmode:        cfg.DbSSLmode,
+		databaseName:   database,
+		sslrootcert:    tls.rootCert,
+		sslcert:        tls.cert,
+		sslkey:         tls.key,
+		connectTimeout: cfg.ConnectTimeout,
+
+		applicationName: cfg.ApplicationName,
+		session:         sessionSettings(cfg),
+	}, retryPolicy{
+		retries: cfg.ConnectRetries,
+		backoff: time.Duration(cfg.ConnectBackoff) * time.Second,
+	})
+	if err != nil {
+		return nil, err
+	}
+	t := &target{
+		database: database,
+		db:       db,
+		applied:  map[string]appliedScript{},
+	}
+
+	if t.serverVersion, err = serverVersion(db); err != nil {
+		t.close()
+		return nil, err
+	}
+	if cfg.AdvisoryLockName != "" && !cfg.DryRun {
+		timeout := time.Duration(cfg.AdvisoryLockTimeout) * time.Second
+		if t.lock, err = acquireAdvisoryLock(db, database, cfg.AdvisoryLockName, timeout); err != nil {
+			t.close()
+			return nil, err
+		}
+	}
+	if cfg.MigrationTracking {
+		if err := t.loadHistory(cfg, scripts); err != nil {
+			t.close()
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+func (t *target) loadHistory(cfg config, scripts []script) error {
+	t.history = newMigrationHistory(t.db, cfg.MigrationTable)
+	exists := true
+	if cfg.DryRun {
+		var err error
+		if exists, err = t.history.exists(); err != nil {
+			return err
+		}
+	} else if err := t.history.ensureTable(); err != nil {
+		return err
+	}
+	if exists {
+		applied, err := t.history.load()
+		if err != nil {
+			return err
+		}
+		t.applied = applied
+	}
+
+	drifted, err := driftedScripts(scripts, t.applied)
+	if err != nil {
+		return err
+	}
+	for _, script := range drifted {
+		if !cfg.MigrationRepair {
+			log.Errorf("Script changed after it was applied: %s", script.name)
+			continue
+		}
+		if cfg.DryRun {
+			log.Warnf("Checksum would be repaired for script: %s", script.name)
+			continue
+		}
+		sum, err := checksum(cfg.ChecksumAlgorithm, script)
+		if err != nil {
+			return err
+		}
+		if err := t.history.updateChecksum(script.name, sum); err != nil {
+			return err
+		}
+		log.Warnf("Repaired checksum of script: %s", script.name)
+	}
+	if len(drifted) > 0 && !cfg.MigrationRepair {
+		return fmt.Errorf("%d applied script(s) changed on disk in database %s, restore them or run with migration_repair enabled to accept the changes", len(drifted), t.database)
+	}
+	return nil
+}
+
+// skipReason returns why a script already applied successfully is not run again, or an empty string
+// if it runs. Repeatable scripts run again whenever their content changes. It is safe to call on a nil
+// target, which is used when there is no database connection in dry run mode.
+func (t *target) skipReason(s script) (string, error) {
+	if t == nil {
+		return "", nil
+	}
+	previous, ok := t.applied[s.name]
+	if !ok || !previous.success {
+		return "", nil
+	}
+	if s.repeatable {
+		match, err := checksumMatches(previous.checksum, s)
+		if err != nil {
+			return "", fmt.Errorf("failed to verify checksum of script %s, error: %s", s.name, err)
+		}
+		if !match {
+			return "", nil
+		}
+		return fmt.Sprintf("unchanged since applied at %s", previous.appliedAt.Format(time.RFC3339)), nil
+	}
+	return fmt.Sprintf("already applied at %s", previous.appliedAt.Format(time.RFC3339)), nil
+}
+
+// version returns the server version, or 0 on a nil target.
+func (t *target) version() int {
+	if t == nil {
+		return 0
+	}
+	return t.serverVersion
+}
+
+// close releases the advisory lock and closes the database. It runs deferred, so the lock
+// is released even if the step panics.
+func (t *target) close() {
+	if t.lock != nil {
+		t.lock.release()
+	}
+	if err := t.db.Close(); err != nil {
+		log.Warnf("failed to close DB")
+	}
+}
+
+// scriptsOf returns the scripts running against a database.
+func scriptsOf(scripts []script, database string) []script {
+	var filtered []script
+	for _, s := range scripts {
+		if s.database == database {
+			filtered = append(filtered, s)
+		}
+	}
+	return filtered
+}
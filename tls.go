@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// tlsFiles are the certificate and key files passed to lib/pq (sslrootcert, sslcert and sslkey).
+// Inputs given as inline PEM are written to temporary files, which are removed by cleanup.
+type tlsFiles struct {
+	rootCert string
+	cert     string
+	key      string
+	temp     []string
+}
+
+// isInlinePEM reports whether an input holds PEM content instead of a file path.
+func isInlinePEM(value string) bool {
+	return strings.Contains(value, "-----BEGIN ")
+}
+
+func prepareTLSFiles(rootCert, cert, key string) (*tlsFiles, error) {
+	files := &tlsFiles{}
+	for _, f := range []struct {
+		input string
+		value string
+		path  *string
+	}{
+		{"sslrootcert", rootCert, &files.rootCert},
+		{"sslcert", cert, &files.cert},
+		{"sslkey", key, &files.key},
+	} {
+		if f.value == "" {
+			continue
+		}
+		if !isInlinePEM(f.value) {
+			if err := checkPath(f.value, false); err != nil {
+				files.cleanup()
+				return nil, fmt.Errorf("invalid %s: %s, error: %s", f.input, f.value, err)
+			}
+			*f.path = f.value
+			continue
+		}
+
+		pth, err := files.writeTemp(f.input, f.value)
+		if err != nil {
+			files.cleanup()
+			return nil, fmt.Errorf("failed to write %s to a temporary file, error: %s", f.input, err)
+		}
+		*f.path = pth
+	}
+	return files, nil
+}
+
+// writeTemp writes inline PEM content to a temporary file readable only by the owner,
+// as lib/pq refuses key files with group or world permissions.
+func (f *tlsFiles) writeTemp(name, content string) (string, error) {
+	file, err := ioutil.TempFile("", "run-sql-"+name+"-")
+	if err != nil {
+		return "", err
+	}
+	f.temp = append(f.temp, file.Name())
+
+	err = file.Chmod(0600)
+	if err == nil {
+		_, err = file.WriteString(strings.TrimSpace(content) + "\n")
+	}
+	if err != nil {
+		if cerr := file.Close(); cerr != nil {
+			log.Warnf("failed to close file: %s, error: %s", file.Name(), cerr)
+		}
+		return "", err
+	}
+	if err := file.Close(); err != nil {
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+func (f *tlsFiles) cleanup() {
+	for _, pth := range f.temp {
+		if err := os.Remove(pth); err != nil {
+			log.Warnf("failed to remove temporary file: %s, error: %s", pth, err)
+		}
+	}
+	f.temp = nil
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/log"
+	nodes "github.com/lfittl/pg_query_go/nodes"
+)
+
+const (
+	transactionNone   = "none"
+	transactionScript = "script"
+	transactionAll    = "all"
+)
+
+// queryer is implemented by *sql.DB, *sql.Tx and pinnedConn, so scripts can run with or without a transaction.
+type queryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	Prepare(query string) (*sql.Stmt, error)
+}
+
+// pinnedConn runs a script without a transaction on a single connection of the pool, so session state
+// (SET, temporary tables, the script's own BEGIN and COMMIT) carries over from one statement to the next.
+type pinnedConn struct {
+	conn *sql.Conn
+}
+
+func (c pinnedConn) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return c.conn.ExecContext(context.Background(), query, args...)
+}
+
+func (c pinnedConn) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return c.conn.QueryContext(context.Background(), query, args...)
+}
+
+func (c pinnedConn) Prepare(query string) (*sql.Stmt, error) {
+	return c.conn.PrepareContext(context.Background(), query)
+}
+
+// Begin starts a transaction on the pinned connection.
+func (c pinnedConn) Begin() (*sql.Tx, error) {
+	return c.conn.BeginTx(context.Background(), nil)
+}
+
+// pinConn takes a connection from the pool for a script, it is returned to the pool by closeConn.
+func pinConn(db *sql.DB) (pinnedConn, error) {
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		return pinnedConn{}, fmt.Errorf("failed to get a database connection, error: %s", err)
+	}
+	return pinnedConn{conn: conn}, nil
+}
+
+func closeConn(c pinnedConn) {
+	if err := c.conn.Close(); err != nil {
+		log.Warnf("failed to return connection to the pool, error: %s", err)
+	}
+}
+
+func rollback(tx *sql.Tx) {
+	if err := tx.Rollback(); err != nil {
+		log.Warnf("failed to roll back transaction, error: %s", err)
+	}
+}
+
+// vacuumOptionVacuum is the VACOPT_VACUUM flag of VacuumStmt.Options (1 << 0 in parsenodes.h),
+// it distinguishes VACUUM from a plain ANALYZE.
+const vacuumOptionVacuum = 1
+
+// enumAddValueInTransactionVersion is the first server version where ALTER TYPE ... ADD VALUE
+// can run inside a transaction block.
+const enumAddValueInTransactionVersion = 120000
+
+// transactionRestriction returns why a statement cannot run inside a transaction block
+// on a server with the given version (server_version_num), or an empty string if it can.
+func transactionRestriction(node nodes.Node, serverVersion int) string {
+	switch n := node.(type) {
+	case nodes.IndexStmt:
+		if n.Concurrent {
+			return "CREATE INDEX CONCURRENTLY"
+		}
+	case nodes.DropStmt:
+		if n.Concurrent {
+			return "DROP INDEX CONCURRENTLY"
+		}
+	case nodes.ReindexStmt:
+		if n.Kind == nodes.REINDEX_OBJECT_SYSTEM || n.Kind == nodes.REINDEX_OBJECT_DATABASE {
+			return "REINDEX SYSTEM/DATABASE"
+		}
+	case nodes.VacuumStmt:
+		if n.Options&vacuumOptionVacuum != 0 {
+			return "VACUUM"
+		}
+	case nodes.AlterEnumStmt:
+		if n.OldVal == nil && serverVersion < enumAddValueInTransactionVersion {
+			return "ALTER TYPE ... ADD VALUE (before PostgreSQL 12)"
+		}
+	case nodes.ClusterStmt:
+		if n.Relation == nil {
+			return "CLUSTER without a table"
+		}
+	case nodes.DiscardStmt:
+		if n.Target == nodes.DISCARD_ALL {
+			return "DISCARD ALL"
+		}
+	case nodes.AlterDatabaseStmt:
+		for _, item := range n.Options.Items {
+			if option, ok := item.(nodes.DefElem); ok && option.Defname != nil && *option.Defname == "tablespace" {
+				return "ALTER DATABASE ... SET TABLESPACE"
+			}
+		}
+	case nodes.CreatedbStmt:
+		return "CREATE DATABASE"
+	case nodes.DropdbStmt:
+		return "DROP DATABASE"
+	case nodes.CreateTableSpaceStmt:
+		return "CREATE TABLESPACE"
+	case nodes.DropTableSpaceStmt:
+		return "DROP TABLESPACE"
+	case nodes.AlterSystemStmt:
+		return "ALTER SYSTEM"
+	case nodes.CreateSubscriptionStmt:
+		return "CREATE SUBSCRIPTION"
+	case nodes.DropSubscriptionStmt:
+		return "DROP SUBSCRIPTION"
+	case nodes.TransactionStmt:
+		switch n.Kind {
+		case nodes.TRANS_STMT_SAVEPOINT, nodes.TRANS_STMT_RELEASE, nodes.TRANS_STMT_ROLLBACK_TO:
+		default:
+			return "transaction control statement"
+		}
+	}
+	return ""
+}
+
+// transactionRestrictions lists the statements of a script that cannot run inside a transaction block.
+func transactionRestrictions(script script, serverVersion int) []string {
+	var restrictions []string
+	for _, stmt := range script.statements {
+		if reason := transactionRestriction(stmt.node, serverVersion); reason != "" {
+			restrictions = append(restrictions, fmt.Sprintf("%s:%d: %s", script.name, stmt.startLine, reason))
+		}
+	}
+	return restrictions
+}
+
+// transactionMode returns the transaction mode of a script, manifest entries can override the step input.
+func (s script) transactionMode(mode string) string {
+	if s.transaction != "" {
+		return s.transaction
+	}
+	return mode
+}
+
+// checkBatch validates the scripts for transaction mode all: they must run against a single database
+// and cannot override the transaction mode or continue on error, since a failure aborts the whole batch.
+func checkBatch(scripts []script) error {
+	for _, s := range scripts {
+		if s.database != scripts[0].database {
+			return fmt.Errorf("transaction_mode: all requires a single database, but scripts run against %s and %s", scripts[0].database, s.database)
+		}
+		if s.transaction != "" {
+			return fmt.Errorf("script %s overrides the transaction mode, which is not allowed with transaction_mode: all", s.name)
+		}
+		if s.continueOnError {
+			return fmt.Errorf("script %s sets continue_on_error, which is not allowed with transaction_mode: all", s.name)
+		}
+	}
+	return nil
+}
+
+// nonTransactionalScripts returns the scripts to run that contain statements which cannot run inside
+// a transaction block. With transaction mode script they run without a transaction, while with
+// transaction mode all the batch cannot be split, so it returns an error. Targets may be nil in dry
+// run mode without a database connection.
+func nonTransactionalScripts(scripts []script, targets map[string]*target, mode string) (map[string]bool, error) {
+	noTransaction := map[string]bool{}
+
+	var restricted []string
+	for _, script := range scripts {
+		t := targets[script.database]
+		if script.transactionMode(mode) == transactionNone {
+			continue
+		}
+		reason, err := t.skipReason(script)
+		if err != nil {
+			return nil, err
+		}
+		if reason != "" {
+			continue
+		}
+		if restrictions := transactionRestrictions(script, t.version()); len(restrictions) > 0 {
+			noTransaction[script.name] = true
+			restricted = append(restricted, restrictions...)
+		}
+	}
+	if len(restricted) > 0 && mode == transactionAll {
+		return nil, fmt.Errorf("statements that cannot run inside a transaction block are not allowed with transaction_mode: all:\n%s", strings.Join(restricted, "\n"))
+	}
+	for _, restriction := range restricted {
+		log.Warnf("Cannot run inside a transaction block: %s", restriction)
+	}
+	return noTransaction, nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+
+	pg_query "github.com/lfittl/pg_query_go"
+	nodes "github.com/lfittl/pg_query_go/nodes"
+)
+
+func TestTransactionRestriction(t *testing.T) {
+	tests := []struct {
+		sql     string
+		version int
+		want    string
+	}{
+		{"SELECT 1", 110000, ""},
+		{"CREATE INDEX i ON t (a)", 110000, ""},
+		{"CREATE INDEX CONCURRENTLY i ON t (a)", 110000, "CREATE INDEX CONCURRENTLY"},
+		{"DROP INDEX CONCURRENTLY i", 110000, "DROP INDEX CONCURRENTLY"},
+		{"DROP INDEX i", 110000, ""},
+		{"REINDEX DATABASE app", 110000, "REINDEX SYSTEM/DATABASE"},
+		{"REINDEX TABLE t", 110000, ""},
+		{"VACUUM", 110000, "VACUUM"},
+		{"VACUUM ANALYZE t", 110000, "VACUUM"},
+		{"ANALYZE", 110000, ""},
+		{"ANALYZE t", 110000, ""},
+		{"ALTER TYPE mood ADD VALUE 'happy'", 110000, "ALTER TYPE ... ADD VALUE (before PostgreSQL 12)"},
+		{"ALTER TYPE mood ADD VALUE 'happy'", 120000, ""},
+		{"ALTER TYPE mood RENAME VALUE 'sad' TO 'blue'", 110000, ""},
+		{"CLUSTER", 110000, "CLUSTER without a table"},
+		{"CLUSTER t USING i", 110000, ""},
+		{"DISCARD ALL", 110000, "DISCARD ALL"},
+		{"DISCARD TEMP", 110000, ""},
+		{"ALTER DATABASE app SET TABLESPACE fast", 110000, "ALTER DATABASE ... SET TABLESPACE"},
+		{"ALTER DATABASE app CONNECTION LIMIT 10", 110000, ""},
+		{"ALTER DATABASE app SET search_path TO app", 110000, ""},
+		{"CREATE DATABASE app", 110000, "CREATE DATABASE"},
+		{"DROP DATABASE app", 110000, "DROP DATABASE"},
+		{"CREATE TABLESPACE fast LOCATION '/ssd'", 110000, "CREATE TABLESPACE"},
+		{"DROP TABLESPACE fast", 110000, "DROP TABLESPACE"},
+		{"ALTER SYSTEM SET work_mem = '64MB'", 110000, "ALTER SYSTEM"},
+		{"CREATE SUBSCRIPTION s CONNECTION 'host=a' PUBLICATION p", 110000, "CREATE SUBSCRIPTION"},
+		{"DROP SUBSCRIPTION s", 110000, "DROP SUBSCRIPTION"},
+		{"BEGIN", 110000, "transaction control statement"},
+		{"COMMIT", 110000, "transaction control statement"},
+		{"SAVEPOINT a", 110000, ""},
+		{"RELEASE SAVEPOINT a", 110000, ""},
+		{"ROLLBACK TO SAVEPOINT a", 110000, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sql, func(t *testing.T) {
+			tree, err := pg_query.Parse(tt.sql)
+			if err != nil {
+				t.Fatalf("Parse() error: %s", err)
+			}
+			if len(tree.Statements) != 1 {
+				t.Fatalf("Parse() returned %d statements, want 1", len(tree.Statements))
+			}
+			raw := tree.Statements[0].(nodes.RawStmt)
+			if got := transactionRestriction(raw.Stmt, tt.version); got != tt.want {
+				t.Errorf("transactionRestriction() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// variableNamePattern matches the names of substituted variables. Unlike psql, names
+// cannot start with a digit, so array slices with numeric bounds like a[1:2] are not mistaken
+// for variables. A bound starting with a letter is a reference: a[1:n] must be written a[1: n].
+var variableNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// parseVariables parses the key=value lines of the variables input and adds the
+// listed environment variables. An environment variable overrides a line of the same name.
+func parseVariables(value string, envNames string) (map[string]string, error) {
+	vars := map[string]string{}
+	for i, line := range strings.Split(value, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		idx := strings.Index(line, "=")
+		if idx == -1 {
+			return nil, fmt.Errorf("invalid variable on line %d, expected key=value: %s", i+1, line)
+		}
+		name := strings.TrimSpace(line[:idx])
+		if !variableNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("invalid variable name on line %d: %s", i+1, name)
+		}
+		vars[name] = line[idx+1:]
+	}
+
+	for _, name := range strings.FieldsFunc(envNames, func(r rune) bool { return r == '\n' || r == ',' || r == ' ' }) {
+		if !variableNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("invalid variable name: %s", name)
+		}
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return nil, fmt.Errorf("environment variable %s is not set", name)
+		}
+		vars[name] = v
+	}
+	return vars, nil
+}
+
+// variableReference parses a psql style variable reference at the start of s:
+//
+//	:name    the value as is
+//	:'name'  the value quoted as a literal
+//	:"name"  the value quoted as an identifier
+//
+// It returns the length of the reference (0 if there is none), the variable name and the quote character.
+func variableReference(s string) (int, string, byte) {
+	if len(s) < 2 || s[0] != ':' {
+		return 0, "", 0
+	}
+	if s[1] == '\'' || s[1] == '"' {
+		end := strings.IndexByte(s[2:], s[1])
+		if end == -1 || !variableNamePattern.MatchString(s[2:2+end]) {
+			return 0, "", 0
+		}
+		return end + 3, s[2 : 2+end], s[1]
+	}
+
+	end := 1
+	for end < len(s) && isVariableNameByte(s[end]) {
+		end++
+	}
+	if !variableNamePattern.MatchString(s[1:end]) {
+		return 0, "", 0
+	}
+	return end, s[1:end], 0
+}
+
+func isVariableNameByte(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// sqlTokenLength returns the length of the keyword or identifier, quoted literal, quoted identifier,
+// dollar quoted string, comment or :: cast at the start of s, or 0 if s starts with anything else.
+func sqlTokenLength(s string) int {
+	switch {
+	case strings.HasPrefix(s, "::"):
+		return 2
+	case strings.HasPrefix(s, "--"):
+		if end := strings.IndexByte(s, '\n'); end != -1 {
+			return end
+		}
+		return len(s)
+	case strings.HasPrefix(s, "/*"):
+		// Block comments nest in PostgreSQL.
+		depth := 0
+		for i := 0; i < len(s)-1; i++ {
+			switch {
+			case s[i] == '/' && s[i+1] == '*':
+				depth++
+				i++
+			case s[i] == '*' && s[i+1] == '/':
+				depth--
+				i++
+				if depth == 0 {
+					return i + 1
+				}
+			}
+		}
+		return len(s)
+	case (s[0] == 'E' || s[0] == 'e') && len(s) > 1 && s[1] == '\'':
+		return 1 + quotedLength(s[1:], '\'', true)
+	case s[0] == '_' || s[0] >= 'a' && s[0] <= 'z' || s[0] >= 'A' && s[0] <= 'Z' || s[0] >= 0x80:
+		// Identifiers may contain $, which must not start a dollar quote.
+		end := 1
+		for end < len(s) && (isVariableNameByte(s[end]) || s[end] == '$' || s[end] >= 0x80) {
+			end++
+		}
+		return end
+	case s[0] == '\'' || s[0] == '"':
+		return quotedLength(s, s[0], false)
+	case s[0] == '$':
+		if tag := dollarQuoteTag(s); tag != "" {
+			if end := strings.Index(s[len(tag):], tag); end != -1 {
+				return len(tag) + end + len(tag)
+			}
+			return len(s)
+		}
+	}
+	return 0
+}
+
+// quotedLength returns the length of the quoted token at the start of s, a doubled quote is an escaped quote.
+func quotedLength(s string, quote byte, backslashEscapes bool) int {
+	for i := 1; i < len(s); i++ {
+		switch {
+		case backslashEscapes && s[i] == '\\':
+			i++
+		case s[i] == quote:
+			if i+1 < len(s) && s[i+1] == quote {
+				i++
+				continue
+			}
+			return i + 1
+		}
+	}
+	return len(s)
+}
+
+var dollarQuoteTagPattern = regexp.MustCompile(`^\$([A-Za-z_\x80-\xff][A-Za-z0-9_\x80-\xff]*)?\$`)
+
+// dollarQuoteTag returns the opening $tag$ of a dollar quoted string at the start of s.
+func dollarQuoteTag(s string) string {
+	return dollarQuoteTagPattern.FindString(s)
+}
+
+// quoteLiteral quotes a value as a string literal the way psql does, using an escape
+// string if it contains backslashes so it is read the same regardless of standard_conforming_strings.
+func quoteLiteral(value string) string {
+	quoted := "'" + strings.Replace(value, "'", "''", -1) + "'"
+	if strings.Contains(value, `\`) {
+		return "E" + strings.Replace(quoted, `\`, `\\`, -1)
+	}
+	return quoted
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseVariables(t *testing.T) {
+	if err := os.Setenv("RUN_SQL_TEST_TENANT", "42"); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := os.Unsetenv("RUN_SQL_TEST_TENANT"); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	tests := []struct {
+		name     string
+		value    string
+		envNames string
+		want     map[string]string
+		wantErr  string
+	}{
+		{
+			name:  "key value lines",
+			value: "schema=app\n\n# comment\n  tenant = a=b \n",
+			want:  map[string]string{"schema": "app", "tenant": " a=b"},
+		},
+		{
+			name:     "environment overrides lines",
+			value:    "RUN_SQL_TEST_TENANT=1",
+			envNames: "RUN_SQL_TEST_TENANT",
+			want:     map[string]string{"RUN_SQL_TEST_TENANT": "42"},
+		},
+		{
+			name:    "missing equals sign",
+			value:   "schema",
+			wantErr: "invalid variable on line 1",
+		},
+		{
+			name:    "name starting with a digit",
+			value:   "1a=b",
+			wantErr: "invalid variable name on line 1: 1a",
+		},
+		{
+			name:     "environment variable not set",
+			envNames: "RUN_SQL_TEST_MISSING",
+			wantErr:  "environment variable RUN_SQL_TEST_MISSING is not set",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseVariables(tt.value, tt.envNames)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseVariables() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseVariables() error: %s", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseVariables() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSubstituteVariables(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		vars    map[string]string
+		want    string
+		wantErr string
+	}{
+		{
+			name:    "value as is, literal and identifier",
+			content: "SELECT :n, :'s', :\"t\" FROM x;",
+			vars:    map[string]string{"n": "1", "s": "it's", "t": "My Table"},
+			want:    "SELECT 1, 'it''s', \"My Table\" FROM x;",
+		},
+		{
+			name:    "backslash in literal",
+			content: "SELECT :'s';",
+			vars:    map[string]string{"s": `a\b`},
+			want:    `SELECT E'a\\b';`,
+		},
+		{
+			name:    "quoted strings, comments, casts and numeric slices are kept",
+			content: "SELECT ':n', $$:n$$, a[1:2], b::text -- :n\nFROM x;",
+			vars:    map[string]string{"n": "1"},
+			want:    "SELECT ':n', $$:n$$, a[1:2], b::text -- :n\nFROM x;",
+		},
+		{
+			name:    "undefined without other variables",
+			content: "SELECT :missing;",
+			wantErr: "test.sql:1: variable missing is not defined",
+		},
+		{
+			name:    "undefined with other variables",
+			content: "SELECT a[1:lim] FROM x WHERE id = :id;",
+			vars:    map[string]string{"id": "1"},
+			wantErr: "test.sql:1: variable lim is not defined",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := preprocessScript("test.sql", "test.sql", tt.content, tt.vars)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("preprocessScript() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("preprocessScript() error: %s", err)
+			}
+			if got := strings.TrimSuffix(got.content, "\n"); got != tt.want {
+				t.Errorf("preprocessScript() content = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	orderingPath    = "path"
+	orderingVersion = "version"
+)
+
+const (
+	directionUp   = "up"
+	directionDown = "down"
+)
+
+// scriptDirection returns up or down for paired migration scripts (V3__add_orders.up.sql,
+// V3__add_orders.down.sql), or an empty string for other scripts.
+func scriptDirection(name string) string {
+	switch {
+	case hasSuffixFold(name, ".up.sql"):
+		return directionUp
+	case hasSuffixFold(name, ".down.sql"):
+		return directionDown
+	default:
+		return ""
+	}
+}
+
+// isRepeatable reports whether a script file name is a repeatable script (R__create_views.sql),
+// which runs again whenever its content changes.
+func isRepeatable(name string) bool {
+	return strings.HasPrefix(name, "R__") && hasSuffixFold(name, ".sql")
+}
+
+// hasSuffixFold reports whether s ends with suffix, ignoring case like the script patterns do.
+func hasSuffixFold(s, suffix string) bool {
+	return len(s) >= len(suffix) && strings.EqualFold(s[len(s)-len(suffix):], suffix)
+}
+
+// repeatablesLast moves repeatable scripts after all other scripts, ordered by file name.
+func repeatablesLast(names []string) []string {
+	var ordered, repeatables []string
+	for _, name := range names {
+		if isRepeatable(path.Base(name)) {
+			repeatables = append(repeatables, name)
+		} else {
+			ordered = append(ordered, name)
+		}
+	}
+	sort.SliceStable(repeatables, func(i, j int) bool {
+		return path.Base(repeatables[i]) < path.Base(repeatables[j])
+	})
+	return append(ordered, repeatables...)
+}
+
+var versionNumberPattern = regexp.MustCompile(`^[0-9]+(?:\.[0-9]+)*$`)
+
+// validateVersion checks a dotted version given as input, for example 1.2.10.
+func validateVersion(version string) error {
+	if !versionNumberPattern.MatchString(version) {
+		return fmt.Errorf("invalid version: %s, expected dot separated numbers (for example 1.2.10)", version)
+	}
+	return nil
+}
+
+// versionedNamePattern matches Flyway style names (V1.2.10__add_orders.sql, V1_2__x.sql) and
+// numeric or timestamp prefixes (001_init.sql, 20190314120000-seed.sql, 1.2.sql), ignoring case.
+var versionedNamePattern = regexp.MustCompile(`(?i)^(?:v([0-9]+(?:[._][0-9]+)*)__(.*)|([0-9]+(?:\.[0-9]+)*)(?:[_-](.*))?)\.sql$`)
+
+// scriptVersion returns the dotted version of a script file name (V1_2__x.sql -> 1.2, 001_x.sql -> 001),
+// or an empty string if the name has no version.
+func scriptVersion(name string) string {
+	match := versionedNamePattern.FindStringSubmatch(name)
+	if match == nil {
+		return ""
+	}
+	if match[1] != "" {
+		return strings.Replace(match[1], "_", ".", -1)
+	}
+	return match[3]
+}
+
+// compareVersions compares dotted versions numerically segment by segment, missing segments count as 0,
+// so 1.2.10 > 1.2.9 and 1.2 == 1.2.0.
+func compareVersions(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		x, y := "0", "0"
+		if i < len(as) {
+			x = as[i]
+		}
+		if i < len(bs) {
+			y = bs[i]
+		}
+		if c := compareNumbers(x, y); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// compareNumbers compares decimal numbers of any length.
+func compareNumbers(a, b string) int {
+	a, b = strings.TrimLeft(a, "0"), strings.TrimLeft(b, "0")
+	if len(a) != len(b) {
+		return len(a) - len(b)
+	}
+	return strings.Compare(a, b)
+}
+
+// orderByVersion sorts script paths by the version in their file names. Names without a version
+// and duplicate versions are rejected, so nothing runs in an ambiguous order. Down scripts share the
+// version of their up script and repeatable scripts have no version, they are kept at the end.
+func orderByVersion(names []string) ([]string, error) {
+	var invalid, unversioned []string
+	versions := map[string]string{}
+	for _, name := range names {
+		if scriptDirection(name) == directionDown || isRepeatable(path.Base(name)) {
+			unversioned = append(unversioned, name)
+			continue
+		}
+		version := scriptVersion(path.Base(name))
+		if version == "" {
+			invalid = append(invalid, name)
+			continue
+		}
+		versions[name] = version
+	}
+	if len(invalid) > 0 {
+		return nil, fmt.Errorf("script names without a version (expected V<version>__<description>.sql or <version>_<description>.sql): %s", strings.Join(invalid, ", "))
+	}
+
+	var ordered []string
+	for _, name := range names {
+		if scriptDirection(name) != directionDown && !isRepeatable(path.Base(name)) {
+			ordered = append(ordered, name)
+		}
+	}
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return compareVersions(versions[ordered[i]], versions[ordered[j]]) < 0
+	})
+
+	var duplicates []string
+	for i := 1; i < len(ordered); i++ {
+		if compareVersions(versions[ordered[i-1]], versions[ordered[i]]) == 0 {
+			duplicates = append(duplicates, fmt.Sprintf("%s and %s (version %s)", ordered[i-1], ordered[i], versions[ordered[i]]))
+		}
+	}
+	if len(duplicates) > 0 {
+		return nil, fmt.Errorf("duplicate script versions: %s", strings.Join(duplicates, ", "))
+	}
+	return append(ordered, unversioned...), nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestScriptVersion(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"V1__init.sql", "1"},
+		{"v1.2.10__add_orders.sql", "1.2.10"},
+		{"V1_2__x.sql", "1.2"},
+		{"V3__add_orders.up.sql", "3"},
+		{"001_init.sql", "001"},
+		{"20190314120000-seed.sql", "20190314120000"},
+		{"1.2.sql", "1.2"},
+		{"V1__Init.SQL", "1"},
+		{"002_seed.Sql", "002"},
+		{"R__views.sql", ""},
+		{"init.sql", ""},
+		{"V1_init.sql", ""},
+		{"001_init.txt", ""},
+	}
+	for _, tt := range tests {
+		if got := scriptVersion(tt.name); got != tt.want {
+			t.Errorf("scriptVersion(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestScriptDirection(t *testing.T) {
+	tests := []struct {
+		name       string
+		direction  string
+		repeatable bool
+	}{
+		{"V3__add_orders.up.sql", directionUp, false},
+		{"V3__add_orders.down.sql", directionDown, false},
+		{"V3__add_orders.UP.SQL", directionUp, false},
+		{"V3__x.DOWN.SQL", directionDown, false},
+		{"V3__add_orders.sql", "", false},
+		{"R__views.sql", "", true},
+		{"R__views.SQL", "", true},
+		{"R__views.txt", "", false},
+		{"views.sql", "", false},
+	}
+	for _, tt := range tests {
+		if got := scriptDirection(tt.name); got != tt.direction {
+			t.Errorf("scriptDirection(%q) = %q, want %q", tt.name, got, tt.direction)
+		}
+		if got := isRepeatable(tt.name); got != tt.repeatable {
+			t.Errorf("isRepeatable(%q) = %t, want %t", tt.name, got, tt.repeatable)
+		}
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.2.10", "1.2.9", 1},
+		{"1.2.9", "1.2.10", -1},
+		{"1.2", "1.2.0", 0},
+		{"1.2", "1.2.1", -1},
+		{"001", "1", 0},
+		{"10", "9", 1},
+		{"20190314120000", "20190314120001", -1},
+		{"2", "1.99", 1},
+	}
+	for _, tt := range tests {
+		got := compareVersions(tt.a, tt.b)
+		if got > 0 {
+			got = 1
+		} else if got < 0 {
+			got = -1
+		}
+		if got != tt.want {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestValidateVersion(t *testing.T) {
+	for _, version := range []string{"1", "1.2.10", "001"} {
+		if err := validateVersion(version); err != nil {
+			t.Errorf("validateVersion(%q) error: %s", version, err)
+		}
+	}
+	for _, version := range []string{"", "v1", "1.", "1..2", "1_2"} {
+		if err := validateVersion(version); err == nil {
+			t.Errorf("validateVersion(%q) expected error", version)
+		}
+	}
+}
+
+func TestRepeatablesLast(t *testing.T) {
+	got := repeatablesLast([]string{"b/R__views.sql", "V2__b.sql", "a/R__functions.sql", "V1__a.sql"})
+	want := []string{"V2__b.sql", "V1__a.sql", "a/R__functions.sql", "b/R__views.sql"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("repeatablesLast() = %v, want %v", got, want)
+	}
+}
+
+func TestOrderByVersion(t *testing.T) {
+	tests := []struct {
+		name    string
+		names   []string
+		want    []string
+		wantErr string
+	}{
+		{
+			name:  "numeric order",
+			names: []string{"V1.2.10__c.sql", "V1.2.9__b.sql", "V1__a.sql"},
+			want:  []string{"V1__a.sql", "V1.2.9__b.sql", "V1.2.10__c.sql"},
+		},
+		{
+			name:  "versions in subdirectories",
+			names: []string{"b/002_x.sql", "a/010_y.sql", "c/1_z.sql"},
+			want:  []string{"c/1_z.sql", "b/002_x.sql", "a/010_y.sql"},
+		},
+		{
+			name:  "down and repeatable scripts at the end",
+			names: []string{"R__views.sql", "V2__b.down.sql", "V2__b.up.sql", "V1__a.sql"},
+			want:  []string{"V1__a.sql", "V2__b.up.sql", "R__views.sql", "V2__b.down.sql"},
+		},
+		{
+			name:  "upper-case extensions",
+			names: []string{"R__views.SQL", "V2__b.DOWN.SQL", "V2__b.UP.SQL", "V1__Init.SQL"},
+			want:  []string{"V1__Init.SQL", "V2__b.UP.SQL", "R__views.SQL", "V2__b.DOWN.SQL"},
+		},
+		{
+			name:    "names without a version",
+			names:   []string{"V1__a.sql", "init.sql", "x/seed.sql"},
+			wantErr: "script names without a version (expected V<version>__<description>.sql or <version>_<description>.sql): init.sql, x/seed.sql",
+		},
+		{
+			name:    "duplicate versions",
+			names:   []string{"V1__a.sql", "V1.0__b.sql", "a/2_c.sql", "b/002_d.sql"},
+			wantErr: "duplicate script versions: V1__a.sql and V1.0__b.sql (version 1.0), a/2_c.sql and b/002_d.sql (version 002)",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := orderByVersion(tt.names)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("orderByVersion() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("orderByVersion() error: %s", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("orderByVersion() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}